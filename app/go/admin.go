@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const adminUsersEnvKey = "ISUCON13_ADMIN_USERS"
+
+// 管理者として扱うユーザ名。未設定の場合は誰も管理APIを使えない
+var adminUsers = map[string]struct{}{}
+
+func init() {
+	for _, name := range strings.Split(os.Getenv(adminUsersEnvKey), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			adminUsers[name] = struct{}{}
+		}
+	}
+}
+
+func verifyAdminSession(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	username, _ := sess.Values[defaultUsernameKey].(string)
+	if _, ok := adminUsers[username]; !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "admin only")
+	}
+
+	return nil
+}
+
+// /api/internal/以下はクラスタ内のノードから直接呼ばれたときだけ受け付ける
+// nginxもクラスタ内のIPから転送してくるので、nginx側でも/api/internal/は外部に公開しない
+func verifyInternalRequest(c echo.Context) error {
+	host, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || slices.Contains(clusterNodes, ip.String())) {
+			return nil
+		}
+	}
+	return echo.NewHTTPError(http.StatusForbidden, "internal API is only available from cluster nodes")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// コミット後のキャッシュ削除を試みる回数
+	cachePurgeAttempts      = 3
+	cachePurgeRetryInterval = 100 * time.Millisecond
+	// 応答しないノードがあってもリクエストを待たせ続けないようにする
+	cachePurgeTimeout = 1 * time.Second
+)
+
+var cachePurgeClient = &http.Client{
+	Timeout: cachePurgeTimeout,
+}
+
+// キャッシュを持つアプリケーションサーバ
+var clusterNodes = []string{
+	"192.168.0.11",
+	"192.168.0.12",
+	"192.168.0.13",
+}
+
+type CachePurgeRequest struct {
+	// tagIDCache, tagNameCacheをDBから読み直す
+	Tags bool `json:"tags"`
+	// livestreamTagsCacheを全て消す
+	LivestreamTags bool `json:"livestream_tags"`
+	// 指定した配信のlivestreamTagsCacheだけを消す
+	LivestreamIDs []int64 `json:"livestream_ids"`
+}
+
+func purgeLocalCache(ctx context.Context, req CachePurgeRequest) error {
+	if req.LivestreamTags {
+		cacheLock.Lock()
+		livestreamTagsCache = sync.Map{}
+		cacheLock.Unlock()
+	}
+	for _, livestreamID := range req.LivestreamIDs {
+		livestreamTagsCache.Delete(livestreamID)
+	}
+	if req.Tags {
+		if err := resetTagCache(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 全ノードのキャッシュを消す
+func broadcastCachePurge(ctx context.Context, req CachePurgeRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, node := range clusterNodes {
+		node := node
+		eg.Go(func() error {
+			r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+node+":8080/api/internal/cache/purge", bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			r.Header.Set("Content-Type", "application/json; charset=UTF-8")
+			resp, err := cachePurgeClient.Do(r)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				return fmt.Errorf("failed to purge cache on %s: %s", node, resp.Status)
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// DBへの変更をコミットした後に全ノードのキャッシュを消す
+// 変更自体は保存されているので、失敗してもリトライしてログに残すだけにする
+func purgeCacheAfterCommit(ctx context.Context, req CachePurgeRequest) {
+	// クライアントが切断してもキャッシュ削除は最後まで行う
+	ctx = context.WithoutCancel(ctx)
+
+	if err := broadcastCachePurge(ctx, req); err == nil {
+		return
+	}
+
+	// 応答を待たせないよう、リトライは裏で行う
+	go func() {
+		var err error
+		for i := 1; i < cachePurgeAttempts; i++ {
+			time.Sleep(cachePurgeRetryInterval)
+			if err = broadcastCachePurge(ctx, req); err == nil {
+				return
+			}
+		}
+		log.Printf("failed to purge cache (%+v): %v", req, err)
+	}()
+}
+
+// キャッシュ削除API
+// 他ノードからの依頼で自ノードのキャッシュを消す
+// POST /api/internal/cache/purge
+func postInternalCachePurgeHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	if err := verifyInternalRequest(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req CachePurgeRequest
+	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	if err := purgeLocalCache(c.Request().Context(), req); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to purge cache: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	collaboratorStatusInvited  = "invited"
+	collaboratorStatusAccepted = "accepted"
+
+	// 1配信あたりのコラボレーター数の上限
+	maxCollaborators = 10
+)
+
+type LivestreamCollaboratorModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	UserID       int64  `db:"user_id"`
+	Status       string `db:"status"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type InviteCollaboratorRequest struct {
+	Username string `json:"username"`
+}
+
+var (
+	// livestreamID(int64) -> 承諾済みコラボレーターのユーザID一覧
+	livestreamCollaboratorsCache = sync.Map{}
+)
+
+func getAcceptedCollaboratorIDs(ctx context.Context, tx *sqlx.Tx, livestreamID int64) ([]int64, error) {
+	if ids, ok := livestreamCollaboratorsCache.Load(livestreamID); ok {
+		return ids.([]int64), nil
+	}
+
+	ids := []int64{}
+	if err := tx.SelectContext(ctx, &ids, "SELECT user_id FROM livestream_collaborators WHERE livestream_id = ? AND status = ? ORDER BY id", livestreamID, collaboratorStatusAccepted); err != nil {
+		return nil, err
+	}
+	livestreamCollaboratorsCache.Store(livestreamID, ids)
+
+	return ids, nil
+}
+
+func fillCollaboratorsResponse(ctx context.Context, tx *sqlx.Tx, livestreamID int64) ([]User, error) {
+	ids, err := getAcceptedCollaboratorIDs(ctx, tx, livestreamID)
+	if err != nil {
+		return nil, err
+	}
+
+	collaborators := make([]User, len(ids))
+	for i, id := range ids {
+		userModel, err := getUser(ctx, tx, id)
+		if err != nil {
+			return nil, err
+		}
+		collaborator, err := fillUserResponse(ctx, tx, userModel)
+		if err != nil {
+			return nil, err
+		}
+		collaborators[i] = collaborator
+	}
+	return collaborators, nil
+}
+
+// 配信者または承諾済みのコラボレーターであれば配信をモデレートできる
+func canModerateLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64) (bool, error) {
+	if livestreamModel.UserID == userID {
+		return true, nil
+	}
+	ids, err := getAcceptedCollaboratorIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		if id == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 配信にコラボレーターを招待する
+func inviteCollaborators(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, usernames []string) error {
+	if len(usernames) > maxCollaborators {
+		return echo.NewHTTPError(http.StatusBadRequest, "too many collaborators: up to "+strconv.Itoa(maxCollaborators))
+	}
+
+	now := time.Now().Unix()
+	for _, username := range usernames {
+		target, err := getUserByName(ctx, tx, username)
+		if err != nil {
+			return err
+		}
+		if target.ID == livestreamModel.UserID {
+			return echo.NewHTTPError(http.StatusBadRequest, "can't invite yourself as a collaborator")
+		}
+		blocked, err := getRestrictedUserIDs(ctx, tx, target.ID, restrictionKindBlock)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user restrictions: "+err.Error())
+		}
+		if _, ok := blocked[livestreamModel.UserID]; ok {
+			return echo.NewHTTPError(http.StatusForbidden, "can't invite a user who blocks you")
+		}
+
+		if _, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO livestream_collaborators (livestream_id, user_id, status, created_at) VALUES (:livestream_id, :user_id, :status, :created_at)", &LivestreamCollaboratorModel{
+			LivestreamID: livestreamModel.ID,
+			UserID:       target.ID,
+			Status:       collaboratorStatusInvited,
+			CreatedAt:    now,
+		}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream collaborator: "+err.Error())
+		}
+	}
+
+	var count int64
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM livestream_collaborators WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream collaborators: "+err.Error())
+	}
+	if count > maxCollaborators {
+		return echo.NewHTTPError(http.StatusBadRequest, "too many collaborators: up to "+strconv.Itoa(maxCollaborators))
+	}
+
+	return nil
+}
+
+// 終了・キャンセルした配信には招待も承諾もできない
+func verifyCollaborationOpen(livestreamModel LivestreamModel) error {
+	switch livestreamModel.EffectiveStatus(time.Now().Unix()) {
+	case livestreamStatusEnded, livestreamStatusCancelled:
+		return echo.NewHTTPError(http.StatusBadRequest, "can't collaborate on a livestream that has ended or been cancelled")
+	}
+	return nil
+}
+
+// コラボレーター招待API
+// POST /api/livestream/:livestream_id/collaborator
+func inviteCollaboratorHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *InviteCollaboratorRequest
+	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, livestreamID, userID)
+	if err != nil {
+		return err
+	}
+	if err := verifyCollaborationOpen(livestreamModel); err != nil {
+		return err
+	}
+	if err := inviteCollaborators(ctx, tx, livestreamModel, []string{req.Username}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// コラボレーター招待の承諾API
+// POST /api/livestream/:livestream_id/collaborator/accept
+func acceptCollaborationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	collaborator := LivestreamCollaboratorModel{}
+	if err := tx.GetContext(ctx, &collaborator, "SELECT * FROM livestream_collaborators WHERE livestream_id = ? AND user_id = ? FOR UPDATE", livestreamID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not invited to the livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborator: "+err.Error())
+	}
+	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	var overlappingIDs []int64
+	if collaborator.Status != collaboratorStatusAccepted {
+		if err := verifyCollaborationOpen(livestreamModel); err != nil {
+			return err
+		}
+		// 自分の他の配信と重なっていないか調べる
+		if overlappingIDs, err = checkReservationOverlap(c, tx, []int64{userID}, livestreamModel.StartAt, livestreamModel.EndAt, livestreamModel.ID); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE livestream_collaborators SET status = ? WHERE id = ?", collaboratorStatusAccepted, collaborator.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream collaborator: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	livestreamCollaboratorsCache.Delete(livestreamModel.ID)
+
+	// コラボレーターのキャッシュをコミット前の内容で埋めないよう、レスポンスはコミット後に作る
+	readTx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer readTx.Rollback()
+
+	livestream, err := fillLivestreamResponse(ctx, readTx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+	livestream.OverlappingLivestreamIDs = overlappingIDs
+
+	if err := readTx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// コラボレーター招待の辞退API
+// POST /api/livestream/:livestream_id/collaborator/decline
+func declineCollaborationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM livestream_collaborators WHERE livestream_id = ? AND user_id = ?", livestreamID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream collaborator: "+err.Error())
+	}
+	if n, err := rs.RowsAffected(); err == nil && n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "not invited to the livestream")
+	}
+	livestreamCollaboratorsCache.Delete(int64(livestreamID))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// コラボレーター削除API
+// 配信者が招待を取り消すか、コラボレーター自身が抜ける
+// DELETE /api/livestream/:livestream_id/collaborator/:username
+func removeCollaboratorHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	target, err := getUserByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+	if livestreamModel.UserID != userID && target.ID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't remove other users from other streamer's livestream")
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_collaborators WHERE livestream_id = ? AND user_id = ?", livestreamModel.ID, target.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream collaborator: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	livestreamCollaboratorsCache.Delete(livestreamModel.ID)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 未承諾のコラボレーター招待一覧API
+// GET /api/user/me/collaboration/invitations
+func getCollaborationInvitationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit, cursor, err := parseCursorPagination(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var invitations []*struct {
+		LivestreamModel
+		InvitationID int64 `db:"invitation_id"`
+	}
+	if err := tx.SelectContext(ctx, &invitations, `
+		SELECT ls.*, lc.id AS invitation_id FROM livestreams ls
+		INNER JOIN livestream_collaborators lc ON lc.livestream_id = ls.id
+		WHERE lc.user_id = ? AND lc.status = ? AND (? = 0 OR lc.id < ?)
+		ORDER BY lc.id DESC
+		LIMIT ?
+		`, userID, collaboratorStatusInvited, cursor.LastID, cursor.LastID, limit+1); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	invitations, hasNext := trimPage(invitations, limit)
+	var nextCursor string
+	if hasNext {
+		nextCursor = encodePageCursor(pageCursor{LastID: invitations[len(invitations)-1].InvitationID})
+	}
+
+	livestreams := make([]Livestream, len(invitations))
+	for i := range invitations {
+		livestream, err := fillLivestreamResponse(ctx, tx, invitations[i].LivestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, Page[Livestream]{Items: livestreams, NextCursor: nextCursor})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+type FollowModel struct {
+	ID         int64 `db:"id"`
+	FollowerID int64 `db:"follower_id"`
+	FolloweeID int64 `db:"followee_id"`
+	CreatedAt  int64 `db:"created_at"`
+}
+
+// 関係の行のIDをcursorに使うため、ユーザと一緒に取得する
+type relatedUserModel struct {
+	UserModel
+	RelationID int64 `db:"relation_id"`
+}
+
+func getUserByName(ctx context.Context, tx *sqlx.Tx, username string) (UserModel, error) {
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserModel{}, echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return UserModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	return userModel, nil
+}
+
+// フォローAPI
+// POST /api/user/:username/follow
+func followUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	followee, err := getUserByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+	if followee.ID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't follow yourself")
+	}
+	blocked, err := getRestrictedUserIDs(ctx, tx, followee.ID, restrictionKindBlock)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user restrictions: "+err.Error())
+	}
+	if _, ok := blocked[userID]; ok {
+		return echo.NewHTTPError(http.StatusForbidden, "you are blocked by this user")
+	}
+	// fillUserResponseがコミット前のフォロー数をキャッシュするので、トランザクションを終えてから消す
+	defer func() {
+		userFullCache.Delete(userID)
+		userFullCache.Delete(followee.ID)
+	}()
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (:follower_id, :followee_id, :created_at)", &FollowModel{
+		FollowerID: userID,
+		FolloweeID: followee.ID,
+		CreatedAt:  time.Now().Unix(),
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert follow: "+err.Error())
+	}
+	if err := addFollowerCount(ctx, tx, followee.ID, rs); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update follower count: "+err.Error())
+	}
+	// レスポンスには更新後のフォロー数を返す
+	userFullCache.Delete(followee.ID)
+
+	user, err := fillUserResponse(ctx, tx, followee)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, user)
+}
+
+// ユーザ検索で並べ替えに使うフォロワー数を、followsへの追加・削除の件数だけ増減させる
+func addFollowerCount(ctx context.Context, tx *sqlx.Tx, followeeID int64, rs sql.Result) error {
+	n, err := rs.RowsAffected()
+	if err != nil || n == 0 {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO user_follower_counts (user_id, followers) VALUES (?, ?) ON DUPLICATE KEY UPDATE followers = followers + VALUES(followers)", followeeID, n)
+	return err
+}
+
+func subtractFollowerCount(ctx context.Context, tx *sqlx.Tx, followeeID int64, rs sql.Result) error {
+	n, err := rs.RowsAffected()
+	if err != nil || n == 0 {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE user_follower_counts SET followers = followers - ? WHERE user_id = ?", n, followeeID)
+	return err
+}
+
+// userIDとtargetIDの間のフォローを両方向とも削除する
+func deleteFollowsBetween(ctx context.Context, tx *sqlx.Tx, userID, targetID int64) error {
+	for _, pair := range [][2]int64{{userID, targetID}, {targetID, userID}} {
+		rs, err := tx.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", pair[0], pair[1])
+		if err != nil {
+			return err
+		}
+		if err := subtractFollowerCount(ctx, tx, pair[1], rs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// フォロー解除API
+// DELETE /api/user/:username/follow
+func unfollowUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	followee, err := getUserByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", userID, followee.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follow: "+err.Error())
+	}
+	if err := subtractFollowerCount(ctx, tx, followee.ID, rs); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update follower count: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	userFullCache.Delete(userID)
+	userFullCache.Delete(followee.ID)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// フォロワー一覧API
+// GET /api/user/:username/followers
+func getFollowersHandler(c echo.Context) error {
+	return listFollowUsers(c, "SELECT u.*, f.id AS relation_id FROM users u INNER JOIN follows f ON f.follower_id = u.id WHERE f.followee_id = ? AND (? = 0 OR f.id < ?) ORDER BY f.id DESC LIMIT ?")
+}
+
+// フォロー中ユーザ一覧API
+// GET /api/user/:username/following
+func getFollowingHandler(c echo.Context) error {
+	return listFollowUsers(c, "SELECT u.*, f.id AS relation_id FROM users u INNER JOIN follows f ON f.followee_id = u.id WHERE f.follower_id = ? AND (? = 0 OR f.id < ?) ORDER BY f.id DESC LIMIT ?")
+}
+
+func listFollowUsers(c echo.Context, query string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	limit, cursor, err := parseCursorPagination(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel, err := getUserByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	var userModels []relatedUserModel
+	if err := tx.SelectContext(ctx, &userModels, query, userModel.ID, cursor.LastID, cursor.LastID, limit+1); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get follows: "+err.Error())
+	}
+	userModels, hasNext := trimPage(userModels, limit)
+	var nextCursor string
+	if hasNext {
+		nextCursor = encodePageCursor(pageCursor{LastID: userModels[len(userModels)-1].RelationID})
+	}
+
+	users := make([]User, len(userModels))
+	for i := range userModels {
+		user, err := fillUserResponse(ctx, tx, userModels[i].UserModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+		users[i] = user
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, Page[User]{Items: users, NextCursor: nextCursor})
+}
+
+// フォロー中の配信者の配信予定・配信中一覧API
+// GET /api/livestream/following
+func getFollowingLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit, cursor, err := parseCursorPagination(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, `
+		SELECT ls.* FROM livestreams ls
+		INNER JOIN follows f ON f.followee_id = ls.user_id
+		WHERE f.follower_id = ? AND ls.end_at > ? AND ls.status IN (?, ?)
+		AND (? = 0 OR ls.start_at > ? OR (ls.start_at = ? AND ls.id > ?))
+		ORDER BY ls.start_at ASC, ls.id ASC
+		LIMIT ?
+		`, userID, time.Now().Unix(), livestreamStatusScheduled, livestreamStatusLive,
+		cursor.LastID, cursor.StartAt, cursor.StartAt, cursor.LastID, limit+1); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	// 開始時刻順なので、直前のページ末尾の(start_at, id)をcursorとする
+	livestreamModels, hasNext := trimPage(livestreamModels, limit)
+	var nextCursor string
+	if hasNext {
+		last := livestreamModels[len(livestreamModels)-1]
+		nextCursor = encodePageCursor(pageCursor{LastID: last.ID, StartAt: last.StartAt})
+	}
+
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, Page[Livestream]{Items: livestreams, NextCursor: nextCursor})
+}
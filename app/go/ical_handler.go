@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	icalProdID = "-//isupipe//livestream schedule//JA"
+	// 終了した配信もしばらくはカレンダーに残す
+	icalPastWindow = 30 * 24 * time.Hour
+	maxICalEvents  = 1000
+	// RFC 5545 3.1 1行あたりの最大オクテット数
+	icalLineLimit = 75
+	// 購読用トークンのランダムなバイト数
+	icalTokenBytes = 32
+)
+
+type ICalTokenModel struct {
+	UserID    int64  `db:"user_id"`
+	Token     string `db:"token"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type ICalTokenResponse struct {
+	Token     string `json:"token"`
+	URL       string `json:"url"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type icalEvent struct {
+	LivestreamModel
+	OwnerName string `db:"owner_name"`
+}
+
+// 配信者のスケジュールのiCalendarエクスポートAPI
+// カレンダーアプリから購読できるようセッションは不要
+// GET /api/user/:username/livestream.ics
+func getUserLivestreamsICalHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel, err := getUserByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	events, err := getICalEvents(ctx, tx, "ls.user_id = ? OR ls.id IN (SELECT livestream_id FROM livestream_collaborators WHERE user_id = ? AND status = ?)", userModel.ID, userModel.ID, collaboratorStatusAccepted)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return respondICal(c, userModel.DisplayName+"の配信スケジュール", events)
+}
+
+// フォロー中の配信者のスケジュールのiCalendarエクスポートAPI
+// カレンダーアプリはセッションを送れないので、tokenクエリでユーザを特定する
+// tokenがなければブラウザからのダウンロードとしてセッションを使う
+// GET /api/livestream/following.ics?token=
+func getFollowingLivestreamsICalHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	if token := c.QueryParam("token"); token != "" {
+		if err := tx.GetContext(ctx, &userID, "SELECT user_id FROM ical_tokens WHERE token = ?", token); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get ical token: "+err.Error())
+		}
+	} else {
+		if err := verifyUserSession(c); err != nil {
+			// echo.NewHTTPErrorが返っているのでそのまま出力
+			return err
+		}
+
+		// error already checked
+		sess, _ := session.Get(defaultSessionIDKey, c)
+		// existence already checked
+		userID = sess.Values[defaultUserIDKey].(int64)
+	}
+
+	events, err := getICalEvents(ctx, tx, "ls.user_id IN (SELECT followee_id FROM follows WHERE follower_id = ?)", userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return respondICal(c, "フォロー中の配信スケジュール", events)
+}
+
+// 購読用トークンの取得API
+// GET /api/user/me/ical_token
+func getICalTokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var tokenModel ICalTokenModel
+	if err := dbConn.GetContext(ctx, &tokenModel, "SELECT * FROM ical_tokens WHERE user_id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "ical token has not been issued")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get ical token: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, newICalTokenResponse(tokenModel))
+}
+
+// 購読用トークンの発行API
+// 発行済みなら作り直し、以前のURLは使えなくなる
+// POST /api/user/me/ical_token
+func postICalTokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	b := make([]byte, icalTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate ical token: "+err.Error())
+	}
+	tokenModel := ICalTokenModel{
+		UserID:    userID,
+		Token:     hex.EncodeToString(b),
+		CreatedAt: time.Now().Unix(),
+	}
+	if _, err := dbConn.NamedExecContext(ctx, "INSERT INTO ical_tokens (user_id, token, created_at) VALUES (:user_id, :token, :created_at) ON DUPLICATE KEY UPDATE token = VALUES(token), created_at = VALUES(created_at)", &tokenModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert ical token: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, newICalTokenResponse(tokenModel))
+}
+
+func newICalTokenResponse(tokenModel ICalTokenModel) ICalTokenResponse {
+	return ICalTokenResponse{
+		Token:     tokenModel.Token,
+		URL:       "/api/livestream/following.ics?token=" + tokenModel.Token,
+		CreatedAt: tokenModel.CreatedAt,
+	}
+}
+
+func getICalEvents(ctx context.Context, tx *sqlx.Tx, cond string, args ...any) ([]icalEvent, error) {
+	query := `
+		SELECT ls.*, u.name AS owner_name FROM livestreams ls
+		INNER JOIN users u ON u.id = ls.user_id
+		WHERE (` + cond + `) AND ls.end_at > ?
+		ORDER BY ls.start_at, ls.id
+		LIMIT ?
+		`
+	args = append(args, time.Now().Add(-icalPastWindow).Unix(), maxICalEvents)
+
+	var events []icalEvent
+	if err := tx.SelectContext(ctx, &events, query, args...); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func respondICal(c echo.Context, calendarName string, events []icalEvent) error {
+	now := time.Now()
+
+	// DTSTAMP以外が同じなら同じETagになるようにする
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(renderICal(calendarName, events, time.Time{}))))
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	if match := c.Request().Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			if t := strings.TrimSpace(tag); t == etag || t == "*" {
+				return c.NoContent(http.StatusNotModified)
+			}
+		}
+	}
+
+	return c.Blob(http.StatusOK, "text/calendar; charset=utf-8", []byte(renderICal(calendarName, events, now)))
+}
+
+func renderICal(calendarName string, events []icalEvent, dtstamp time.Time) string {
+	var b strings.Builder
+	writeICalLine(&b, "BEGIN:VCALENDAR")
+	writeICalLine(&b, "VERSION:2.0")
+	writeICalLine(&b, "PRODID:"+icalProdID)
+	writeICalLine(&b, "CALSCALE:GREGORIAN")
+	writeICalLine(&b, "X-WR-CALNAME:"+escapeICalText(calendarName))
+
+	for _, event := range events {
+		status := "CONFIRMED"
+		if event.Status == livestreamStatusCancelled {
+			status = "CANCELLED"
+		}
+
+		writeICalLine(&b, "BEGIN:VEVENT")
+		writeICalLine(&b, fmt.Sprintf("UID:livestream-%d@u.isucon.dev", event.ID))
+		if !dtstamp.IsZero() {
+			writeICalLine(&b, "DTSTAMP:"+formatICalTime(dtstamp.Unix()))
+		}
+		writeICalLine(&b, "DTSTART:"+formatICalTime(event.StartAt))
+		writeICalLine(&b, "DTEND:"+formatICalTime(event.EndAt))
+		writeICalLine(&b, fmt.Sprintf("SEQUENCE:%d", event.Sequence))
+		writeICalLine(&b, "STATUS:"+status)
+		writeICalLine(&b, "SUMMARY:"+escapeICalText(event.Title))
+		writeICalLine(&b, "DESCRIPTION:"+escapeICalText(event.Description))
+		writeICalLine(&b, fmt.Sprintf("URL:https://%s.u.isucon.dev/watch/%d", event.OwnerName, event.ID))
+		writeICalLine(&b, "END:VEVENT")
+	}
+
+	writeICalLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+func formatICalTime(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format("20060102T150405Z")
+}
+
+// RFC 5545 3.3.11
+func escapeICalText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(s)
+}
+
+// 75オクテットを超える行は、UTF-8の文字の途中で切らないように折り返す
+func writeICalLine(b *strings.Builder, line string) {
+	limit := icalLineLimit
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !isUTF8Start(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// 継続行は先頭の空白の分だけ短くする
+		limit = icalLineLimit - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+func isUTF8Start(c byte) bool {
+	return c&0xC0 != 0x80
+}
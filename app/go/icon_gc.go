@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	iconGCInterval = 1 * time.Hour
+	// アップロード直後でまだiconsに登録されていないファイルを消さないための猶予
+	iconGCGracePeriod = 10 * time.Minute
+	// graceクエリで指定できる最小の猶予
+	iconGCMinGracePeriod = 1 * time.Minute
+)
+
+// アイコンの <hash>.jpg と縮小版の <hash>_<size>.jpg
+// 配信サムネイルの thumb_<hash>.jpg と縮小版の thumb_<hash>_<width>.jpg
+var iconObjectNamePattern = regexp.MustCompile(`^((?:thumb_)?[0-9a-f]{64})(?:_[0-9]+)?\.jpg$`)
+
+// 同じ内容の画像を再アップロードすると同じ名前で上書きされるので、
+// GCが参照を調べた後に上書きされたファイルを消さないよう、書き込みと削除の確認を排他にする
+var iconGCLock sync.RWMutex
+
+type IconGCResult struct {
+	ScannedFiles   int   `json:"scanned_files"`
+	DeletedFiles   int   `json:"deleted_files"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+}
+
+func startIconGC() {
+	ticker := time.NewTicker(iconGCInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := collectIconGarbage(context.Background(), time.Now().Add(-iconGCGracePeriod))
+		if err != nil {
+			log.Printf("failed to collect icon garbage: %v", err)
+			continue
+		}
+		log.Printf("icon gc: scanned=%d deleted=%d reclaimed=%dbytes", result.ScannedFiles, result.DeletedFiles, result.ReclaimedBytes)
+	}
+}
+
+// どのicons.hash, livestreams.thumbnail_hashからも参照されていないファイルのうち、cutoffより前に作られたものを削除する
+func collectIconGarbage(ctx context.Context, cutoff time.Time) (IconGCResult, error) {
+	// 一覧を取ってから参照を集めることで、その間にアップロードされたファイルを消さないようにする
+	objects, err := iconStore.List(ctx)
+	if err != nil {
+		return IconGCResult{}, err
+	}
+
+	var hashes []string
+	if err := dbConn.SelectContext(ctx, &hashes, "SELECT DISTINCT hash FROM icons"); err != nil {
+		return IconGCResult{}, err
+	}
+	var thumbnailHashes []string
+	if err := dbConn.SelectContext(ctx, &thumbnailHashes, "SELECT DISTINCT thumbnail_hash FROM livestreams WHERE thumbnail_hash != ''"); err != nil {
+		return IconGCResult{}, err
+	}
+	referenced := make(map[string]struct{}, len(hashes)+len(thumbnailHashes))
+	for _, hash := range hashes {
+		referenced[hash] = struct{}{}
+	}
+	for _, hash := range thumbnailHashes {
+		referenced[getThumbnailObjectPrefix(hash)] = struct{}{}
+	}
+
+	result := IconGCResult{}
+	for _, object := range objects {
+		if !object.ModTime.Before(cutoff) {
+			continue
+		}
+
+		// 書き込み途中で残った一時ファイルも掃除する
+		tmp := strings.HasSuffix(object.Name, ".tmp")
+		m := iconObjectNamePattern.FindStringSubmatch(object.Name)
+		if !tmp && m == nil {
+			// NoImage.jpgなど管理外のファイル
+			continue
+		}
+		result.ScannedFiles++
+		if !tmp {
+			if _, ok := referenced[m[1]]; ok {
+				continue
+			}
+		}
+
+		deleted, err := deleteIconObjectIfOlder(ctx, object.Name, cutoff)
+		if err != nil {
+			return result, err
+		}
+		if deleted {
+			result.DeletedFiles++
+			result.ReclaimedBytes += object.Size
+		}
+	}
+
+	return result, nil
+}
+
+// 一覧を取った後に上書きされていないか確かめてから削除する
+func deleteIconObjectIfOlder(ctx context.Context, name string, cutoff time.Time) (bool, error) {
+	iconGCLock.Lock()
+	defer iconGCLock.Unlock()
+
+	object, err := iconStore.Stat(ctx, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !object.ModTime.Before(cutoff) {
+		return false, nil
+	}
+
+	if err := iconStore.Delete(ctx, name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
+
+// 未参照のアイコン画像の削除
+// POST /api/internal/icon/gc
+func postInternalIconGCHandler(c echo.Context) error {
+	if err := verifyInternalRequest(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	grace := iconGCGracePeriod
+	if v := c.QueryParam("grace"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || time.Duration(seconds)*time.Second < iconGCMinGracePeriod {
+			return echo.NewHTTPError(http.StatusBadRequest, "grace query parameter must be integer of at least "+strconv.Itoa(int(iconGCMinGracePeriod/time.Second)))
+		}
+		grace = time.Duration(seconds) * time.Second
+	}
+
+	result, err := collectIconGarbage(c.Request().Context(), time.Now().Add(-grace))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to collect icon garbage: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
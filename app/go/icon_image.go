@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	// アップロードを受け付ける画像の最大バイト数
+	maxIconUploadSize = 5 << 20
+	// デコードを許す元画像の最大の縦横ピクセル数 (展開爆弾対策)
+	maxIconSourceDimension = 4096
+	// 正規化後のアイコンの最大の一辺
+	iconMaxDimension = 512
+	iconJPEGQuality  = 90
+)
+
+var errInvalidImage = errors.New("invalid image")
+
+// 正規化と縮小版の作り方のうち、画像の種類ごとに異なる部分
+type imageFormat struct {
+	// エラーメッセージに使う名前
+	label string
+	// 切り抜く縦横比
+	aspectWidth, aspectHeight int
+	// 正規化後の最大の幅
+	maxWidth int
+	// 配信できる縮小版の幅。アップロード時に全て作っておく
+	variantWidths []int
+
+	objectName        func(hash string) string
+	variantObjectName func(hash string, width int) string
+}
+
+// アイコンは正方形に切り抜く
+var iconImageFormat = imageFormat{
+	label:             "icon",
+	aspectWidth:       1,
+	aspectHeight:      1,
+	maxWidth:          iconMaxDimension,
+	variantWidths:     []int{64, 128, 256},
+	objectName:        getUserIconObjectName,
+	variantObjectName: getUserIconVariantObjectName,
+}
+
+// boundsの中央から縦横比に合う最大の範囲を返す
+func (f imageFormat) cropRect(bounds image.Rectangle) image.Rectangle {
+	w, h := bounds.Dx(), bounds.Dx()*f.aspectHeight/f.aspectWidth
+	if h > bounds.Dy() {
+		w, h = bounds.Dy()*f.aspectWidth/f.aspectHeight, bounds.Dy()
+	}
+	x0 := bounds.Min.X + (bounds.Dx()-w)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-h)/2
+	return image.Rect(x0, y0, x0+w, y0+h)
+}
+
+// 幅widthを超えないよう、縦横比を保ってsrcのrの範囲を縮小する
+// 拡大はしない
+func (f imageFormat) shrink(src *image.RGBA, r image.Rectangle, width int) ([]byte, error) {
+	width = min(width, r.Dx())
+	height := max(width*f.aspectHeight/f.aspectWidth, 1)
+	return encodeJPEG(resizeImage(src, r, width, height))
+}
+
+// アップロードされた画像を検証し、中央を縦横比に合わせて切り抜いたJPEGへ正規化する
+// 再エンコードするのでEXIFなどのメタデータは取り除かれる
+func (f imageFormat) normalize(data []byte) ([]byte, error) {
+	img, err := decodeUploadedImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	r := f.cropRect(img.Bounds())
+	if r.Dx() <= 0 || r.Dy() <= 0 {
+		return nil, fmt.Errorf("%w: image is too small", errInvalidImage)
+	}
+	return f.shrink(img, r, f.maxWidth)
+}
+
+// 正規化済みの画像を幅widthに縮小する
+func (f imageFormat) resize(data []byte, width int) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	return f.shrink(rgba, f.cropRect(rgba.Bounds()), width)
+}
+
+func (f imageFormat) putVariant(ctx context.Context, hash string, original []byte, width int) error {
+	b, err := f.resize(original, width)
+	if err != nil {
+		return err
+	}
+	return iconStore.Put(ctx, f.variantObjectName(hash, width), b)
+}
+
+// 縮小版が無ければ元画像から生成する
+func (f imageFormat) ensureVariant(ctx context.Context, hash string, width int) error {
+	exists, err := iconStore.Exists(ctx, f.variantObjectName(hash, width))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	original, err := iconStore.Get(ctx, f.objectName(hash))
+	if err != nil {
+		return err
+	}
+	return f.putVariant(ctx, hash, original, width)
+}
+
+// 画像を正規化して縮小版と共に保存し、そのハッシュを返す
+func (f imageFormat) save(ctx context.Context, data []byte) (string, error) {
+	// 書き込んでいる間はGCに消させない
+	iconGCLock.RLock()
+	defer iconGCLock.RUnlock()
+
+	// 正規化後の画像でハッシュを取り、ETagが配信する内容と一致するようにする
+	normalized, err := f.normalize(data)
+	if errors.Is(err, errInvalidImage) {
+		return "", echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to normalize %s image: %s", f.label, err.Error()))
+	}
+
+	hash := sha256.Sum256(normalized)
+	hexHash := hex.EncodeToString(hash[:])
+	if err := iconStore.Put(ctx, f.objectName(hexHash), normalized); err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to save %s: %s", f.label, err.Error()))
+	}
+
+	// 縮小版も先に作っておく
+	// ローカルディスクの場合、配信するインスタンスからは見えないのでここで作るしかない
+	for _, width := range f.variantWidths {
+		if err := f.putVariant(ctx, hexHash, normalized, width); err != nil {
+			return "", echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to resize %s: %s", f.label, err.Error()))
+		}
+	}
+
+	return hexHash, nil
+}
+
+func decodeUploadedImage(data []byte) (*image.RGBA, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: empty image", errInvalidImage)
+	}
+	if len(data) > maxIconUploadSize {
+		return nil, fmt.Errorf("%w: image must be smaller than %d bytes", errInvalidImage, maxIconUploadSize)
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidImage, err.Error())
+	}
+	switch format {
+	case "jpeg", "png", "gif":
+	default:
+		return nil, fmt.Errorf("%w: unsupported format %s", errInvalidImage, format)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxIconSourceDimension || cfg.Height > maxIconSourceDimension {
+		return nil, fmt.Errorf("%w: image must be at most %dx%d", errInvalidImage, maxIconSourceDimension, maxIconSourceDimension)
+	}
+
+	// GIFは先頭フレームのみ使う
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidImage, err.Error())
+	}
+
+	// 透過部分は白背景に合成する
+	rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Over)
+	return rgba, nil
+}
+
+// srcのrの範囲を面積平均でwidth x heightに縮小する
+func resizeImage(src *image.RGBA, r image.Rectangle, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	sw, sh := r.Dx(), r.Dy()
+
+	for y := 0; y < height; y++ {
+		sy0 := r.Min.Y + y*sh/height
+		sy1 := max(r.Min.Y+(y+1)*sh/height, sy0+1)
+		for x := 0; x < width; x++ {
+			sx0 := r.Min.X + x*sw/width
+			sx1 := max(r.Min.X+(x+1)*sw/width, sx0+1)
+
+			var rs, gs, bs, n uint32
+			for sy := sy0; sy < sy1; sy++ {
+				i := src.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					rs += uint32(src.Pix[i])
+					gs += uint32(src.Pix[i+1])
+					bs += uint32(src.Pix[i+2])
+					n++
+					i += 4
+				}
+			}
+
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(rs / n)
+			dst.Pix[j+1] = uint8(gs / n)
+			dst.Pix[j+2] = uint8(bs / n)
+			dst.Pix[j+3] = 0xff
+		}
+	}
+
+	return dst
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: iconJPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
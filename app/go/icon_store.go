@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	iconStoreEnvKey            = "ISUCON13_ICON_STORE"
+	iconStoreDirEnvKey         = "ISUCON13_ICON_STORE_DIR"
+	iconStoreAccelPrefixEnvKey = "ISUCON13_ICON_STORE_ACCEL_PREFIX"
+	iconS3EndpointEnvKey       = "ISUCON13_ICON_S3_ENDPOINT"
+	iconS3BucketEnvKey         = "ISUCON13_ICON_S3_BUCKET"
+	iconS3RegionEnvKey         = "ISUCON13_ICON_S3_REGION"
+	iconS3AccessKeyEnvKey      = "ISUCON13_ICON_S3_ACCESS_KEY"
+	iconS3SecretKeyEnvKey      = "ISUCON13_ICON_S3_SECRET_KEY"
+	iconS3ServeModeEnvKey      = "ISUCON13_ICON_S3_SERVE"
+
+	iconS3ServeRedirect = "redirect"
+	iconS3ServeProxy    = "proxy"
+
+	iconS3PresignExpiry = 15 * time.Minute
+)
+
+// アイコン画像の保存先
+// 存在しないオブジェクトに対してはfs.ErrNotExistをラップしたエラーを返す
+type IconStore interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	Exists(ctx context.Context, name string) (bool, error)
+	Stat(ctx context.Context, name string) (IconObject, error)
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context) ([]IconObject, error)
+	// nameのオブジェクトをレスポンスとして返す
+	Serve(c echo.Context, name string) error
+	// 全インスタンスから同じオブジェクトが見えるかどうか
+	Shared() bool
+}
+
+type IconObject struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+var iconStore IconStore = &localIconStore{
+	dir:         UserIconImageDir,
+	accelPrefix: UserIconImageDir,
+}
+
+func newIconStoreFromEnv() (IconStore, error) {
+	switch v := os.Getenv(iconStoreEnvKey); v {
+	case "", "local":
+		store := &localIconStore{
+			dir:         UserIconImageDir,
+			accelPrefix: UserIconImageDir,
+		}
+		if dir, ok := os.LookupEnv(iconStoreDirEnvKey); ok {
+			store.dir = dir
+			store.accelPrefix = dir
+		}
+		// 空文字を指定するとX-Accel-Redirectを使わずに直接配信する
+		if prefix, ok := os.LookupEnv(iconStoreAccelPrefixEnvKey); ok {
+			store.accelPrefix = prefix
+		}
+		return store, nil
+	case "s3":
+		endpoint, err := url.Parse(os.Getenv(iconS3EndpointEnvKey))
+		if err != nil || endpoint.Host == "" {
+			return nil, fmt.Errorf("environ %s must be a valid URL", iconS3EndpointEnvKey)
+		}
+		store := &s3IconStore{
+			endpoint:  endpoint,
+			bucket:    os.Getenv(iconS3BucketEnvKey),
+			region:    os.Getenv(iconS3RegionEnvKey),
+			accessKey: os.Getenv(iconS3AccessKeyEnvKey),
+			secretKey: os.Getenv(iconS3SecretKeyEnvKey),
+			serveMode: os.Getenv(iconS3ServeModeEnvKey),
+			client:    &http.Client{Timeout: 10 * time.Second},
+		}
+		if store.bucket == "" {
+			return nil, fmt.Errorf("environ %s must be provided", iconS3BucketEnvKey)
+		}
+		if store.region == "" {
+			store.region = "us-east-1"
+		}
+		switch store.serveMode {
+		case "":
+			store.serveMode = iconS3ServeRedirect
+		case iconS3ServeRedirect, iconS3ServeProxy:
+		default:
+			return nil, fmt.Errorf("environ %s must be %s or %s", iconS3ServeModeEnvKey, iconS3ServeRedirect, iconS3ServeProxy)
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown icon store: %s", v)
+	}
+}
+
+// ローカルディスクに保存する
+type localIconStore struct {
+	dir string
+	// nginxのinternal locationのprefix。空ならアプリから直接配信する
+	accelPrefix string
+}
+
+func (s *localIconStore) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *localIconStore) Put(ctx context.Context, name string, data []byte) error {
+	// 書き込み途中のファイルが配信されないようにrenameで置き換える
+	tmp := fmt.Sprintf("%s.%s.tmp", s.path(name), uuid.NewString())
+	if err := os.WriteFile(tmp, data, 0777); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(name))
+}
+
+func (s *localIconStore) Get(ctx context.Context, name string) ([]byte, error) {
+	return os.ReadFile(s.path(name))
+}
+
+func (s *localIconStore) Exists(ctx context.Context, name string) (bool, error) {
+	if _, err := os.Stat(s.path(name)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *localIconStore) Stat(ctx context.Context, name string) (IconObject, error) {
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return IconObject{}, err
+	}
+	return IconObject{
+		Name:    name,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+func (s *localIconStore) Delete(ctx context.Context, name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *localIconStore) List(ctx context.Context) ([]IconObject, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]IconObject, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, IconObject{
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	return objects, nil
+}
+
+func (s *localIconStore) Serve(c echo.Context, name string) error {
+	if s.accelPrefix == "" {
+		return c.File(s.path(name))
+	}
+	c.Response().Header().Set("X-Accel-Redirect", s.accelPrefix+"/"+name)
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *localIconStore) Shared() bool {
+	return false
+}
+
+// S3互換のオブジェクトストレージに保存する
+// MinIOなどでも使えるようにpath-styleでアクセスする
+type s3IconStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	serveMode string
+	client    *http.Client
+}
+
+func (s *s3IconStore) objectURL(name string) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + name
+	u.RawQuery = ""
+	return &u
+}
+
+func (s *s3IconStore) do(ctx context.Context, method, name string, body []byte) (*http.Response, error) {
+	return s.doURL(ctx, method, s.objectURL(name), body)
+}
+
+func (s *s3IconStore) doURL(ctx context.Context, method string, u *url.URL, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, "image/jpeg")
+	}
+	s.sign(req, body, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s: %w", method, u.Path, fs.ErrNotExist)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("s3: %s %s: %s: %s", method, u.Path, resp.Status, string(b))
+	}
+	return resp, nil
+}
+
+func (s *s3IconStore) Put(ctx context.Context, name string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, name, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3IconStore) Get(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3IconStore) Exists(ctx context.Context, name string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, name, nil)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (s *s3IconStore) Stat(ctx context.Context, name string) (IconObject, error) {
+	resp, err := s.do(ctx, http.MethodHead, name, nil)
+	if err != nil {
+		return IconObject{}, err
+	}
+	resp.Body.Close()
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return IconObject{}, fmt.Errorf("s3: HEAD %s: invalid Last-Modified: %w", name, err)
+	}
+	return IconObject{
+		Name:    name,
+		Size:    resp.ContentLength,
+		ModTime: modTime,
+	}, nil
+}
+
+func (s *s3IconStore) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, name, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3IconStore) List(ctx context.Context) ([]IconObject, error) {
+	var objects []IconObject
+	continuationToken := ""
+	for {
+		u := *s.endpoint
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		u.RawQuery = s3CanonicalQuery(query)
+
+		resp, err := s.doURL(ctx, http.MethodGet, &u, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, IconObject{
+				Name:    content.Key,
+				Size:    content.Size,
+				ModTime: content.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (s *s3IconStore) Serve(c echo.Context, name string) error {
+	if s.serveMode == iconS3ServeRedirect {
+		return c.Redirect(http.StatusFound, s.presign(name, time.Now()))
+	}
+
+	resp, err := s.do(c.Request().Context(), http.MethodGet, name, nil)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found icon")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon: "+err.Error())
+	}
+	defer resp.Body.Close()
+	return c.Stream(http.StatusOK, "image/jpeg", resp.Body)
+}
+
+func (s *s3IconStore) Shared() bool {
+	return true
+}
+
+// AWS Signature Version 4 でヘッダに署名する
+func (s *s3IconStore) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headerValues := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if ct := req.Header.Get(echo.HeaderContentType); ct != "" {
+		signedHeaders = append(signedHeaders, "content-type")
+		headerValues["content-type"] = ct
+		sort.Strings(signedHeaders)
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		canonicalHeaders.WriteString(h + ":" + headerValues[h] + "\n")
+	}
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	signature := s.signature(date, amzDate, scope, canonicalRequest)
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// 署名付きURLを発行する
+func (s *s3IconStore) presign(name string, now time.Time) string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	scope := date + "/" + s.region + "/s3/aws4_request"
+
+	u := s.objectURL(name)
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.accessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int(iconS3PresignExpiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		s3EscapePath(u.Path),
+		s3CanonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	query.Set("X-Amz-Signature", s.signature(date, amzDate, scope, canonicalRequest))
+
+	u.RawQuery = s3CanonicalQuery(query)
+	return u.String()
+}
+
+func (s *s3IconStore) signature(date, amzDate, scope, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i := range segments {
+		segments[i] = s3Escape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
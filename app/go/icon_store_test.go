@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeS3Bucket    = "icons"
+	fakeS3Region    = "ap-northeast-1"
+	fakeS3AccessKey = "test-access-key"
+	fakeS3SecretKey = "test-secret-key"
+	// ListObjectsV2のページングを確かめるため、1ページの件数を小さくする
+	fakeS3MaxKeys = 2
+)
+
+type fakeS3Object struct {
+	data    []byte
+	modTime time.Time
+}
+
+// MinIOの代わりにテストで使う、path-styleのS3互換サーバ
+// 署名はs3IconStoreの実装を使わずに検証する
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+	// 署名の検証に失敗したリクエストの数
+	rejected int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *s3IconStore) {
+	t.Helper()
+	f := &fakeS3{objects: map[string]fakeS3Object{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	endpoint, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, &s3IconStore{
+		endpoint:  endpoint,
+		bucket:    fakeS3Bucket,
+		region:    fakeS3Region,
+		accessKey: fakeS3AccessKey,
+		secretKey: fakeS3SecretKey,
+		serveMode: iconS3ServeProxy,
+		client:    server.Client(),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := verifyFakeS3Signature(r, body); err != nil {
+		f.rejected++
+		http.Error(w, "SignatureDoesNotMatch: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != fakeS3Bucket {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	if key == "" {
+		if r.Method != http.MethodGet || r.URL.Query().Get("list-type") != "2" {
+			http.Error(w, "unsupported bucket operation", http.StatusBadRequest)
+			return
+		}
+		f.list(w, r.URL.Query().Get("continuation-token"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[key] = fakeS3Object{data: body, modTime: time.Now().UTC().Truncate(time.Second)}
+	case http.MethodGet, http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", obj.modTime.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodDelete:
+		// S3は存在しないキーの削除も成功扱いにする
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, token string) {
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		if key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	}
+	result := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}{}
+	if len(keys) > fakeS3MaxKeys {
+		keys = keys[:fakeS3MaxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		obj := f.objects[key]
+		result.Contents = append(result.Contents, content{Key: key, Size: int64(len(obj.data)), LastModified: obj.modTime})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// AWS Signature Version 4 の仕様どおりに受け取ったリクエストから署名を計算し直して突き合わせる
+func verifyFakeS3Signature(r *http.Request, body []byte) error {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return errors.New("missing AWS4-HMAC-SHA256 authorization")
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[k] = v
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) != len("20060102T150405Z") {
+		return errors.New("invalid X-Amz-Date")
+	}
+	scope := amzDate[:8] + "/" + fakeS3Region + "/s3/aws4_request"
+	if fields["Credential"] != fakeS3AccessKey+"/"+scope {
+		return errors.New("unexpected credential: " + fields["Credential"])
+	}
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	if r.Header.Get("X-Amz-Content-Sha256") != payloadHash {
+		return errors.New("payload hash mismatch")
+	}
+
+	query := r.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for k := range query {
+		queryKeys = append(queryKeys, k)
+	}
+	sort.Strings(queryKeys)
+	pairs := []string{}
+	for _, k := range queryKeys {
+		for _, v := range query[k] {
+			pairs = append(pairs, strings.ReplaceAll(url.QueryEscape(k), "+", "%20")+"="+strings.ReplaceAll(url.QueryEscape(v), "+", "%20"))
+		}
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Join(pairs, "&"),
+		canonicalHeaders.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac([]byte("AWS4"+fakeS3SecretKey), amzDate[:8])
+	key = mac(key, fakeS3Region)
+	key = mac(key, "s3")
+	key = mac(key, "aws4_request")
+	if expected := hex.EncodeToString(mac(key, stringToSign)); fields["Signature"] != expected {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// IconStoreの実装が共通して満たすべき振る舞いを確かめる
+func testIconStore(t *testing.T, store IconStore) {
+	ctx := context.Background()
+	names := []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg", "e.jpg"}
+	for i, name := range names {
+		if err := store.Put(ctx, name, bytes.Repeat([]byte{byte(i)}, i+1)); err != nil {
+			t.Fatalf("Put(%s): %v", name, err)
+		}
+	}
+
+	// 同じ名前で書き直すと中身が置き換わる
+	if err := store.Put(ctx, "a.jpg", []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Get(ctx, "a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "replaced" {
+		t.Errorf("Get(a.jpg) = %q, want %q", data, "replaced")
+	}
+
+	if ok, err := store.Exists(ctx, "b.jpg"); err != nil || !ok {
+		t.Errorf("Exists(b.jpg) = %v, %v, want true", ok, err)
+	}
+	obj, err := store.Stat(ctx, "c.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Name != "c.jpg" || obj.Size != 3 || obj.ModTime.IsZero() {
+		t.Errorf("Stat(c.jpg) = %+v", obj)
+	}
+
+	objects, err := store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		listed = append(listed, obj.Name)
+		if obj.ModTime.IsZero() {
+			t.Errorf("List: %s has no ModTime", obj.Name)
+		}
+	}
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != strings.Join(names, ",") {
+		t.Errorf("List = %v, want %v", listed, names)
+	}
+
+	if err := store.Delete(ctx, "d.jpg"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 存在しないオブジェクトはfs.ErrNotExistになる
+	if _, err := store.Get(ctx, "d.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get(deleted) error = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := store.Stat(ctx, "missing.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(missing) error = %v, want fs.ErrNotExist", err)
+	}
+	if ok, err := store.Exists(ctx, "missing.jpg"); err != nil || ok {
+		t.Errorf("Exists(missing) = %v, %v, want false", ok, err)
+	}
+	objects, err = store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != len(names)-1 {
+		t.Errorf("List after Delete returned %d objects, want %d", len(objects), len(names)-1)
+	}
+}
+
+func TestLocalIconStore(t *testing.T) {
+	dir := t.TempDir()
+	// ディレクトリはアイコンとして扱わない
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	store := &localIconStore{dir: dir}
+	testIconStore(t, store)
+
+	if err := store.Delete(context.Background(), "missing.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Delete(missing) error = %v, want fs.ErrNotExist", err)
+	}
+	// renameで置き換えるので書き込み用の一時ファイルが残らない
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmps) != 0 {
+		t.Errorf("temporary files are left: %v", tmps)
+	}
+}
+
+func TestS3IconStore(t *testing.T) {
+	f, store := newFakeS3(t)
+	testIconStore(t, store)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rejected != 0 {
+		t.Errorf("%d requests had an invalid signature", f.rejected)
+	}
+	// ページングを跨いで全件取れていることを確かめるため、1ページに収まらない件数があること
+	if len(f.objects) <= fakeS3MaxKeys {
+		t.Fatalf("fake S3 has %d objects, need more than %d to exercise pagination", len(f.objects), fakeS3MaxKeys)
+	}
+}
+
+func TestS3IconStoreRejectsWrongSecret(t *testing.T) {
+	f, store := newFakeS3(t)
+	store.secretKey = "wrong"
+
+	err := store.Put(context.Background(), "a.jpg", []byte("x"))
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Put with wrong secret error = %v, want a signature error", err)
+	}
+	if f.rejected != 1 {
+		t.Errorf("fake S3 rejected %d requests, want 1", f.rejected)
+	}
+}
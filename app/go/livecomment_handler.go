@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -80,29 +79,59 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	limit, cursor, legacy, err := parseLegacyCompatiblePagination(c)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	// ブロック・ミュートしているユーザのコメントは表示しない
+	hiddenUserIDs, err := getHiddenUserIDs(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user restrictions: "+err.Error())
+	}
+
+	query := "SELECT * FROM livecomments WHERE livestream_id = ?"
+	args := []interface{}{livestreamID}
+	if len(hiddenUserIDs) > 0 {
+		query += " AND user_id NOT IN (?)"
+		args = append(args, hiddenUserIDs)
+	}
+	if cursor.LastID > 0 {
+		query += " AND id < ?"
+		args = append(args, cursor.LastID)
+	}
+	// 続きがあるかを知るために1件多く取得する
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit+1)
+	query, args, err = sqlx.In(query, args...)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
 	}
 
 	livecommentModels := []LivecommentModel{}
-	err = tx.SelectContext(ctx, &livecommentModels, query, livestreamID)
+	err = tx.SelectContext(ctx, &livecommentModels, query, args...)
 	if errors.Is(err, sql.ErrNoRows) {
-		return c.JSON(http.StatusOK, []*Livecomment{})
+		return respondPage(c, legacy, []Livecomment{}, "")
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
+	livecommentModels, hasNext := trimPage(livecommentModels, limit)
+	var nextCursor string
+	if hasNext {
+		nextCursor = encodePageCursor(pageCursor{LastID: livecommentModels[len(livecommentModels)-1].ID})
+	}
 
 	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
 	if err != nil {
@@ -127,7 +156,7 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livecomments)
+	return respondPage(c, legacy, livecomments, nextCursor)
 }
 
 func getNgwords(c echo.Context) error {
@@ -153,8 +182,24 @@ func getNgwords(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	// 配信者とコラボレーターは、配信に登録された全員分のNGワードを見られる
+	query := "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC"
+	args := []any{userID, livestreamID}
+	if livestreamModel, err := getLivestream(ctx, tx, livestreamID); err == nil {
+		canModerate, err := canModerateLivestream(ctx, tx, livestreamModel, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+		}
+		if canModerate {
+			query = "SELECT * FROM ng_words WHERE livestream_id = ? ORDER BY created_at DESC"
+			args = []any{livestreamID}
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
 	var ngWords []*NGWord
-	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", userID, livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &ngWords, query, args...); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.JSON(http.StatusOK, []*NGWord{})
 		} else {
@@ -207,6 +252,14 @@ func postLivecommentHandler(c echo.Context) error {
 		}
 	}
 
+	banned, err := isBannedByStreamer(ctx, tx, livestreamModel.UserID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user restrictions: "+err.Error())
+	}
+	if banned {
+		return echo.NewHTTPError(http.StatusForbidden, "you are banned from this streamer's livestreams")
+	}
+
 	// スパム判定
 	var ngwords []*NGWord
 	if cached, ok := ngwordsCache.Load(livestreamID); ok {
@@ -387,12 +440,19 @@ func moderateHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// 配信者自身の配信に対するmoderateなのかを検証
-	var ownedLivestreams []LivestreamModel
-	if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
+	// 配信者自身かコラボレーターによるmoderateなのかを検証
+	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	if len(ownedLivestreams) == 0 {
+	canModerate, err := canModerateLivestream(ctx, tx, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+	}
+	if !canModerate {
 		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
 	}
 
@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
 	"sync"
@@ -24,6 +23,8 @@ type ReserveLivestreamRequest struct {
 	ThumbnailUrl string  `json:"thumbnail_url"`
 	StartAt      int64   `json:"start_at"`
 	EndAt        int64   `json:"end_at"`
+	// コラボレーターとして招待するユーザ名
+	Collaborators []string `json:"collaborators"`
 }
 
 type LivestreamViewerModel struct {
@@ -41,6 +42,13 @@ type LivestreamModel struct {
 	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
 	StartAt      int64  `db:"start_at" json:"start_at"`
 	EndAt        int64  `db:"end_at" json:"end_at"`
+	SeriesID     *int64 `db:"series_id" json:"series_id"`
+	// 保存されている状態。実際の状態はEffectiveStatusで求める
+	Status string `db:"status" json:"status"`
+	// 配信予約が変更されるたびに増える。iCalendarのSEQUENCEに使う
+	Sequence int64 `db:"sequence" json:"sequence"`
+	// アップロードされたサムネイル画像のハッシュ。空ならThumbnailUrlを使う
+	ThumbnailHash string `db:"thumbnail_hash" json:"thumbnail_hash"`
 }
 
 type Livestream struct {
@@ -53,6 +61,12 @@ type Livestream struct {
 	Tags         []Tag  `json:"tags"`
 	StartAt      int64  `json:"start_at"`
 	EndAt        int64  `json:"end_at"`
+	SeriesID     *int64 `json:"series_id,omitempty"`
+	Status       string `json:"status"`
+	// 招待を承諾したコラボレーター
+	Collaborators []User `json:"collaborators"`
+	// 予約・変更APIのレスポンスでだけ、重なりを警告する方針のときに重なっている配信のIDを返す
+	OverlappingLivestreamIDs []int64 `json:"overlapping_livestream_ids,omitempty"`
 }
 
 type LivestreamTagModel struct {
@@ -104,6 +118,9 @@ func reserveLivestreamHandler(c echo.Context) error {
 	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
+	if err := validateMediaURLs(ctx, req.PlaylistUrl, req.ThumbnailUrl); err != nil {
+		return err
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -111,52 +128,58 @@ func reserveLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// 2023/11/25 10:00からの１年間の期間内であるかチェック
-	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
-	)
-	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
-		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	if err := validateReservationTerm(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	// 配信者やコラボレーターの他の配信と重なっていないか調べる
+	participantIDs, err := getReservationParticipantIDs(ctx, tx, userID, req.Collaborators)
+	if err != nil {
+		return err
+	}
+	overlappingIDs, err := checkReservationOverlap(c, tx, participantIDs, req.StartAt, req.EndAt, 0)
+	if err != nil {
+		return err
 	}
 
 	// 予約枠をみて、予約が可能か調べる
-	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
-	var slots []*ReservationSlotModel
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
-		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-	}
-	for _, slot := range slots {
-		var count int
-		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-		}
-		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-		if count < 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
-		}
+	if err := takeReservationSlots(ctx, tx, req.StartAt, req.EndAt); err != nil {
+		return err
 	}
 
-	var (
-		livestreamModel = &LivestreamModel{
-			UserID:       int64(userID),
-			Title:        req.Title,
-			Description:  req.Description,
-			PlaylistUrl:  req.PlaylistUrl,
-			ThumbnailUrl: req.ThumbnailUrl,
-			StartAt:      req.StartAt,
-			EndAt:        req.EndAt,
-		}
-	)
+	livestreamModel := &LivestreamModel{
+		UserID:       int64(userID),
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		StartAt:      req.StartAt,
+		EndAt:        req.EndAt,
+	}
+	if err := insertLivestream(ctx, tx, livestreamModel, req.Tags); err != nil {
+		return err
+	}
+	if err := inviteCollaborators(ctx, tx, *livestreamModel, req.Collaborators); err != nil {
+		return err
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+	livestream.OverlappingLivestreamIDs = overlappingIDs
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// 配信とタグを登録し、採番したIDをlivestreamModelに設定する
+func insertLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, tagIDs []int64) error {
+	livestreamModel.Status = livestreamStatusScheduled
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, series_id, status) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :series_id, :status)", livestreamModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
 	}
@@ -168,31 +191,28 @@ func reserveLivestreamHandler(c echo.Context) error {
 	livestreamModel.ID = livestreamID
 
 	// タグ追加
-	for _, tagID := range req.Tags {
+	for _, tagID := range tagIDs {
 		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
 			LivestreamID: livestreamID,
 			TagID:        tagID,
 		}); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
 		}
-		livestreamTagsCache.Delete(livestreamID)
 	}
+	livestreamTagsCache.Delete(livestreamID)
 
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
-	return c.JSON(http.StatusCreated, livestream)
+	return nil
 }
 
+// 配信検索API
+// GET /api/livestream/search?q=&tag=&tag_mode=&owner=&from=&to=&status=&sort=&limit=&cursor=
 func searchLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	keyTagName := c.QueryParam("tag")
+
+	q, err := parseLivestreamSearchQuery(c)
+	if err != nil {
+		return err
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -200,44 +220,24 @@ func searchLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var livestreamModels []*LivestreamModel
-	if c.QueryParam("tag") != "" {
-		// タグによる取得
-		//var tagIDList []int
-		//if err := tx.SelectContext(ctx, &tagIDList, "SELECT id FROM tags WHERE name = ?", keyTagName); err != nil {
-		//	return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
-		//}
-		tag, err := getTagByName(keyTagName)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
-		}
-
-		// クエリを実行して結果を取得
-		if err := tx.SelectContext(ctx, &livestreamModels, `
-			SELECT ls.* FROM livestreams ls
-			INNER JOIN livestream_tags lt ON ls.id = lt.livestream_id AND lt.tag_id = ?
-			`, tag.ID); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-		}
-	} else {
-		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
-		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
-			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
-		}
-
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	results, err := searchLivestreams(ctx, tx, q)
+	if err != nil {
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			return err
 		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	results, hasNext := trimPage(results, q.Limit)
+	var nextCursor string
+	if hasNext {
+		last := results[len(results)-1]
+		nextCursor = encodePageCursor(pageCursor{LastID: last.ID, Score: last.Relevance})
 	}
 
-	livestreams := make([]Livestream, len(livestreamModels))
-	for i := range livestreamModels {
-		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+	livestreams := make([]Livestream, len(results))
+	for i := range results {
+		livestream, err := fillLivestreamResponse(ctx, tx, results[i].LivestreamModel)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 		}
@@ -248,7 +248,7 @@ func searchLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return respondPage(c, q.Legacy, livestreams, nextCursor)
 }
 
 func getMyLivestreamsHandler(c echo.Context) error {
@@ -257,6 +257,11 @@ func getMyLivestreamsHandler(c echo.Context) error {
 		return err
 	}
 
+	limit, cursor, legacy, err := parseLegacyCompatiblePagination(c)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -269,9 +274,14 @@ func getMyLivestreamsHandler(c echo.Context) error {
 	userID := sess.Values[defaultUserIDKey].(int64)
 
 	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? AND (? = 0 OR id < ?) ORDER BY id DESC LIMIT ?", userID, cursor.LastID, cursor.LastID, limit+1); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
+	livestreamModels, hasNext := trimPage(livestreamModels, limit)
+	var nextCursor string
+	if hasNext {
+		nextCursor = encodePageCursor(pageCursor{LastID: livestreamModels[len(livestreamModels)-1].ID})
+	}
 	livestreams := make([]Livestream, len(livestreamModels))
 	for i := range livestreamModels {
 		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
@@ -285,7 +295,7 @@ func getMyLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return respondPage(c, legacy, livestreams, nextCursor)
 }
 
 func getUserLivestreamsHandler(c echo.Context) error {
@@ -296,6 +306,11 @@ func getUserLivestreamsHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
+	limit, cursor, legacy, err := parseLegacyCompatiblePagination(c)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -312,9 +327,21 @@ func getUserLivestreamsHandler(c echo.Context) error {
 	}
 
 	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
+	// コラボレーターとして参加している配信も含める
+	if err := tx.SelectContext(ctx, &livestreamModels, `
+		SELECT * FROM livestreams
+		WHERE (user_id = ? OR id IN (SELECT livestream_id FROM livestream_collaborators WHERE user_id = ? AND status = ?))
+		AND (? = 0 OR id < ?)
+		ORDER BY id DESC
+		LIMIT ?
+		`, user.ID, user.ID, collaboratorStatusAccepted, cursor.LastID, cursor.LastID, limit+1); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
+	livestreamModels, hasNext := trimPage(livestreamModels, limit)
+	var nextCursor string
+	if hasNext {
+		nextCursor = encodePageCursor(pageCursor{LastID: livestreamModels[len(livestreamModels)-1].ID})
+	}
 	livestreams := make([]Livestream, len(livestreamModels))
 	for i := range livestreamModels {
 		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
@@ -328,7 +355,7 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return respondPage(c, legacy, livestreams, nextCursor)
 }
 
 // viewerテーブルの廃止
@@ -355,19 +382,36 @@ func enterLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	viewer := LivestreamViewerModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		CreatedAt:    time.Now().Unix(),
+	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
 
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
+	banned, err := isBannedByStreamer(ctx, tx, livestreamModel.UserID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user restrictions: "+err.Error())
+	}
+	if banned {
+		return echo.NewHTTPError(http.StatusForbidden, "you are banned from this streamer's livestreams")
+	}
+
+	now := time.Now()
+	if err := insertViewerHistory(ctx, tx, int64(livestreamID), userID, now); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
 	}
+	if _, err := touchPresence(ctx, tx, int64(livestreamID), userID, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream presence: "+err.Error())
+	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	if _, err := updateViewerPeak(ctx, int64(livestreamID), now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update peak viewers: "+err.Error())
+	}
 
 	return c.NoContent(http.StatusOK)
 }
@@ -395,8 +439,9 @@ func exitLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
+	// 視聴履歴は残し、現在の視聴者からだけ外す
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_presences WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream presence: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -456,6 +501,11 @@ func getLivecommentReportsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	limit, cursor, legacy, err := parseLegacyCompatiblePagination(c)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -472,14 +522,23 @@ func getLivecommentReportsHandler(c echo.Context) error {
 	// existence already check
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	if livestreamModel.UserID != userID {
+	canModerate, err := canModerateLivestream(ctx, tx, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+	}
+	if !canModerate {
 		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
 	}
 
 	var reportModels []*LivecommentReportModel
-	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ? AND (? = 0 OR id < ?) ORDER BY id DESC LIMIT ?", livestreamID, cursor.LastID, cursor.LastID, limit+1); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
 	}
+	reportModels, hasNext := trimPage(reportModels, limit)
+	var nextCursor string
+	if hasNext {
+		nextCursor = encodePageCursor(pageCursor{LastID: reportModels[len(reportModels)-1].ID})
+	}
 
 	reports := make([]LivecommentReport, len(reportModels))
 	for i := range reportModels {
@@ -494,7 +553,7 @@ func getLivecommentReportsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, reports)
+	return respondPage(c, legacy, reports, nextCursor)
 }
 
 var (
@@ -521,16 +580,24 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 		livestreamTagsCache.Store(livestreamModel.ID, tags)
 	}
 
+	collaborators, err := fillCollaboratorsResponse(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return Livestream{}, err
+	}
+
 	livestream := Livestream{
-		ID:           livestreamModel.ID,
-		Owner:        owner,
-		Title:        livestreamModel.Title,
-		Tags:         tags,
-		Description:  livestreamModel.Description,
-		PlaylistUrl:  livestreamModel.PlaylistUrl,
-		ThumbnailUrl: livestreamModel.ThumbnailUrl,
-		StartAt:      livestreamModel.StartAt,
-		EndAt:        livestreamModel.EndAt,
+		ID:            livestreamModel.ID,
+		Owner:         owner,
+		Title:         livestreamModel.Title,
+		Tags:          tags,
+		Description:   livestreamModel.Description,
+		PlaylistUrl:   livestreamModel.PlaylistUrl,
+		ThumbnailUrl:  getLivestreamThumbnailURL(livestreamModel),
+		StartAt:       livestreamModel.StartAt,
+		EndAt:         livestreamModel.EndAt,
+		SeriesID:      livestreamModel.SeriesID,
+		Status:        livestreamModel.EffectiveStatus(time.Now().Unix()),
+		Collaborators: collaborators,
 	}
 	return livestream, nil
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	tagModeAnd = "and"
+	tagModeOr  = "or"
+
+	livestreamSortRelevance = "relevance"
+	livestreamSortRecent    = "recent"
+)
+
+type LivestreamSearchQuery struct {
+	// タイトル・説明文・タグ名に対するキーワード
+	Keyword  string
+	TagNames []string
+	TagMode  string
+	Owner    string
+	// 配信時間帯が[From, To)と重なるものに絞る。0は指定なし
+	From   int64
+	To     int64
+	Status string
+	Sort   string
+	Limit  int
+	Cursor pageCursor
+	// cursorクエリの無い従来の呼び出し
+	Legacy bool
+}
+
+type livestreamSearchResult struct {
+	LivestreamModel
+	// キーワードとの関連度。キーワードが無ければ0
+	Relevance float64 `db:"relevance"`
+}
+
+func parseLivestreamSearchQuery(c echo.Context) (LivestreamSearchQuery, error) {
+	q := LivestreamSearchQuery{
+		Keyword: strings.TrimSpace(c.QueryParam("q")),
+		TagMode: tagModeOr,
+		Owner:   c.QueryParam("owner"),
+		Status:  c.QueryParam("status"),
+		Sort:    c.QueryParam("sort"),
+	}
+
+	// tag=a&tag=b と tag=a,b のどちらでも指定できる
+	for _, v := range c.QueryParams()["tag"] {
+		for _, name := range strings.Split(v, ",") {
+			if name != "" {
+				q.TagNames = append(q.TagNames, name)
+			}
+		}
+	}
+
+	switch v := c.QueryParam("tag_mode"); v {
+	case "":
+	case tagModeAnd, tagModeOr:
+		q.TagMode = v
+	default:
+		return LivestreamSearchQuery{}, echo.NewHTTPError(http.StatusBadRequest, "tag_mode query parameter must be and or or")
+	}
+
+	switch q.Sort {
+	case "":
+		if q.Keyword != "" {
+			q.Sort = livestreamSortRelevance
+		} else {
+			q.Sort = livestreamSortRecent
+		}
+	case livestreamSortRecent:
+	case livestreamSortRelevance:
+		if q.Keyword == "" {
+			return LivestreamSearchQuery{}, echo.NewHTTPError(http.StatusBadRequest, "sort=relevance requires q query parameter")
+		}
+	default:
+		return LivestreamSearchQuery{}, echo.NewHTTPError(http.StatusBadRequest, "sort query parameter must be relevance or recent")
+	}
+
+	var err error
+	if q.From, err = parseUnixQueryParam(c, "from", 0); err != nil {
+		return LivestreamSearchQuery{}, err
+	}
+	if q.To, err = parseUnixQueryParam(c, "to", 0); err != nil {
+		return LivestreamSearchQuery{}, err
+	}
+
+	if q.Limit, q.Cursor, q.Legacy, err = parseLegacyCompatiblePagination(c); err != nil {
+		return LivestreamSearchQuery{}, err
+	}
+
+	return q, nil
+}
+
+// キーワードを名前に含むタグのID一覧
+func findTagIDsContaining(keyword string) []int64 {
+	keyword = strings.ToLower(keyword)
+	var ids []int64
+	for _, tag := range tagIDCache.Items() {
+		if strings.Contains(strings.ToLower(tag.Name), keyword) {
+			ids = append(ids, tag.ID)
+		}
+	}
+	return ids
+}
+
+// 検索条件に合う配信を、続きの有無がわかるようLimitより1件多く取得する
+// 条件を満たしえない場合はnil, nilを返す
+func searchLivestreams(ctx context.Context, tx *sqlx.Tx, q LivestreamSearchQuery) ([]*livestreamSearchResult, error) {
+	var (
+		selects    = []string{"ls.*"}
+		selectArgs []any
+		conds      = []string{"1 = 1"}
+		args       []any
+	)
+
+	if q.Keyword != "" {
+		// NOTE: title, descriptionにはngramパーサのFULLTEXTインデックスを張っている
+		relevance := "MATCH(ls.title, ls.description) AGAINST (? IN NATURAL LANGUAGE MODE)"
+		relevanceArgs := []any{q.Keyword}
+		cond := relevance
+		condArgs := []any{q.Keyword}
+		if tagIDs := findTagIDsContaining(q.Keyword); len(tagIDs) > 0 {
+			tagMatch := "ls.id IN (SELECT livestream_id FROM livestream_tags WHERE tag_id IN (?))"
+			relevance += " + (" + tagMatch + ")"
+			relevanceArgs = append(relevanceArgs, tagIDs)
+			cond = "(" + cond + " OR " + tagMatch + ")"
+			condArgs = append(condArgs, tagIDs)
+		}
+		selects = append(selects, relevance+" AS relevance")
+		selectArgs = append(selectArgs, relevanceArgs...)
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	if len(q.TagNames) > 0 {
+		var tagIDs []int64
+		for _, name := range q.TagNames {
+			tag, err := getTagByName(name)
+			if errors.Is(err, sql.ErrNoRows) {
+				if q.TagMode == tagModeAnd {
+					return nil, nil
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			tagIDs = append(tagIDs, tag.ID)
+		}
+		if len(tagIDs) == 0 {
+			return nil, nil
+		}
+
+		if q.TagMode == tagModeAnd {
+			conds = append(conds, "ls.id IN (SELECT livestream_id FROM livestream_tags WHERE tag_id IN (?) GROUP BY livestream_id HAVING COUNT(DISTINCT tag_id) = ?)")
+			args = append(args, tagIDs, len(tagIDs))
+		} else {
+			conds = append(conds, "ls.id IN (SELECT livestream_id FROM livestream_tags WHERE tag_id IN (?))")
+			args = append(args, tagIDs)
+		}
+	}
+
+	if q.Owner != "" {
+		owner, err := getUserByName(ctx, tx, q.Owner)
+		if err != nil {
+			var he *echo.HTTPError
+			if errors.As(err, &he) && he.Code == http.StatusNotFound {
+				return nil, nil
+			}
+			return nil, err
+		}
+		conds = append(conds, "ls.user_id = ?")
+		args = append(args, owner.ID)
+	}
+
+	if q.From > 0 {
+		conds = append(conds, "ls.end_at > ?")
+		args = append(args, q.From)
+	}
+	if q.To > 0 {
+		conds = append(conds, "ls.start_at < ?")
+		args = append(args, q.To)
+	}
+
+	if q.Status != "" {
+		cond, condArgs, err := livestreamStatusCondition(q.Status, time.Now().Unix())
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	// 関連度順では直前のページ末尾の(関連度, ID)より後ろを、新着順ではIDより後ろを取る
+	var having string
+	if q.Cursor.LastID > 0 {
+		if q.Sort == livestreamSortRelevance {
+			having = " HAVING relevance < ? OR (relevance = ? AND ls.id < ?)"
+			args = append(args, q.Cursor.Score, q.Cursor.Score, q.Cursor.LastID)
+		} else {
+			conds = append(conds, "ls.id < ?")
+			args = append(args, q.Cursor.LastID)
+		}
+	}
+
+	query := "SELECT " + strings.Join(selects, ", ") + " FROM livestreams ls WHERE " + strings.Join(conds, " AND ") + having
+	if q.Sort == livestreamSortRelevance {
+		query += " ORDER BY relevance DESC, ls.id DESC LIMIT ?"
+		args = append(args, q.Limit+1)
+	} else {
+		query += " ORDER BY ls.id DESC LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	query, inArgs, err := sqlx.In(query, append(selectArgs, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*livestreamSearchResult
+	if err := tx.SelectContext(ctx, &results, query, inArgs...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
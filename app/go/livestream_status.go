@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	livestreamStatusScheduled = "scheduled"
+	livestreamStatusLive      = "live"
+	livestreamStatusEnded     = "ended"
+	livestreamStatusCancelled = "cancelled"
+)
+
+// 保存されている状態と現在時刻から、配信の実際の状態を求める
+// 配信者が明示的に開始・終了していなければ、予約された時間帯に従う
+func (l LivestreamModel) EffectiveStatus(now int64) string {
+	switch l.Status {
+	case livestreamStatusEnded, livestreamStatusCancelled:
+		return l.Status
+	case livestreamStatusLive:
+		if now >= l.EndAt {
+			return livestreamStatusEnded
+		}
+		return livestreamStatusLive
+	default:
+		switch {
+		case now < l.StartAt:
+			return livestreamStatusScheduled
+		case now < l.EndAt:
+			return livestreamStatusLive
+		default:
+			return livestreamStatusEnded
+		}
+	}
+}
+
+// EffectiveStatusと同じ判定をするWHERE句の条件
+// livestreamsテーブルの別名はlsとする
+func livestreamStatusCondition(status string, now int64) (string, []any, error) {
+	switch status {
+	case livestreamStatusScheduled:
+		return "(ls.status = ? AND ls.start_at > ?)", []any{livestreamStatusScheduled, now}, nil
+	case livestreamStatusLive:
+		return "((ls.status = ? AND ls.end_at > ?) OR (ls.status = ? AND ls.start_at <= ? AND ls.end_at > ?))", []any{livestreamStatusLive, now, livestreamStatusScheduled, now, now}, nil
+	case livestreamStatusEnded:
+		return "(ls.status = ? OR (ls.status IN (?, ?) AND ls.end_at <= ?))", []any{livestreamStatusEnded, livestreamStatusScheduled, livestreamStatusLive, now}, nil
+	case livestreamStatusCancelled:
+		return "ls.status = ?", []any{livestreamStatusCancelled}, nil
+	default:
+		return "", nil, echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be one of scheduled, live, ended or cancelled")
+	}
+}
+
+// 配信開始API
+// 予約時刻より早く開始することもできる
+// POST /api/livestream/:livestream_id/start
+func startLivestreamHandler(c echo.Context) error {
+	return transitLivestreamStatus(c, func(livestreamModel *LivestreamModel, now int64) error {
+		switch livestreamModel.EffectiveStatus(now) {
+		case livestreamStatusScheduled, livestreamStatusLive:
+			livestreamModel.Status = livestreamStatusLive
+			return nil
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "can't start a livestream that has ended or been cancelled")
+		}
+	})
+}
+
+// 配信終了API
+// POST /api/livestream/:livestream_id/end
+func endLivestreamHandler(c echo.Context) error {
+	return transitLivestreamStatus(c, func(livestreamModel *LivestreamModel, now int64) error {
+		if livestreamModel.EffectiveStatus(now) != livestreamStatusLive {
+			return echo.NewHTTPError(http.StatusBadRequest, "can't end a livestream that is not live")
+		}
+		livestreamModel.Status = livestreamStatusEnded
+		return nil
+	})
+}
+
+// 配信を終えたときに返却してよい予約枠の開始時刻
+// 予約開始前に始めて終えた場合でも、確保していない予約開始前の枠は返却しない
+// 使用中の枠も返却しないよう、次の予約枠の境界に切り上げる
+func remainingReservationStartAt(livestreamModel LivestreamModel, now int64) int64 {
+	return ceilReservationSlotBoundary(max(now, livestreamModel.StartAt))
+}
+
+func transitLivestreamStatus(c echo.Context, transit func(livestreamModel *LivestreamModel, now int64) error) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, livestreamID, userID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	if err := transit(&livestreamModel, now); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET status = ?, sequence = sequence + 1 WHERE id = ?", livestreamModel.Status, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+	// 予定より早く終えた場合は、残りの予約枠を返却する
+	if livestreamModel.Status == livestreamStatusEnded {
+		if err := releaseReservationSlots(ctx, tx, remainingReservationStartAt(livestreamModel, now), livestreamModel.EndAt); err != nil {
+			return err
+		}
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	livestreamCache.Delete(livestreamID)
+
+	return c.JSON(http.StatusOK, livestream)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"testing/quick"
+)
+
+func TestRemainingReservationStartAt(t *testing.T) {
+	slotSeconds := reservationConfig.SlotSeconds
+	termStartAt := reservationConfig.SlotOrigin.Unix()
+
+	property := func(startSlot uint8, length uint8, elapsed uint32) bool {
+		livestreamModel := LivestreamModel{
+			StartAt: termStartAt + int64(startSlot)*slotSeconds,
+		}
+		livestreamModel.EndAt = livestreamModel.StartAt + int64(length%24+1)*slotSeconds
+
+		// 予約開始の前後どちらで終えても、予約区間の外の枠や使用中の枠は返却しない
+		now := livestreamModel.StartAt - 2*slotSeconds + int64(elapsed)%(int64(length%24+3)*slotSeconds)
+		startAt := remainingReservationStartAt(livestreamModel, now)
+		if startAt < livestreamModel.StartAt || startAt < now {
+			return false
+		}
+		// 予約枠の境界にそろっている
+		if (startAt-termStartAt)%slotSeconds != 0 {
+			return false
+		}
+		// 切り上げすぎて、未使用の枠を返却し損ねることもない
+		return startAt-max(now, livestreamModel.StartAt) < slotSeconds
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRemainingReservationStartAtStartedEarly(t *testing.T) {
+	slotSeconds := reservationConfig.SlotSeconds
+	livestreamModel := LivestreamModel{
+		StartAt: reservationConfig.SlotOrigin.Unix() + 10*slotSeconds,
+	}
+	livestreamModel.EndAt = livestreamModel.StartAt + 3*slotSeconds
+
+	// 予約開始の2枠前に始めて、予約開始前に終えた場合は予約した3枠だけを返す
+	now := livestreamModel.StartAt - slotSeconds - 1
+	if got := remainingReservationStartAt(livestreamModel, now); got != livestreamModel.StartAt {
+		t.Errorf("remainingReservationStartAt() = %d, want %d", got, livestreamModel.StartAt)
+	}
+
+	// 予約区間の1枠目の途中で終えた場合は残りの2枠を返す
+	now = livestreamModel.StartAt + slotSeconds/2
+	if got := remainingReservationStartAt(livestreamModel, now); got != livestreamModel.StartAt+slotSeconds {
+		t.Errorf("remainingReservationStartAt() = %d, want %d", got, livestreamModel.StartAt+slotSeconds)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 1配信に付与できるタグの最大数
+const maxLivestreamTags = 10
+
+type PutLivestreamTagsRequest struct {
+	Tags []int64 `json:"tags"`
+}
+
+// タグIDが全て存在するか調べ、重複を除いて返す
+func validateLivestreamTagIDs(tagIDs []int64) ([]int64, error) {
+	seen := make(map[int64]struct{}, len(tagIDs))
+	validated := make([]int64, 0, len(tagIDs))
+	for _, tagID := range tagIDs {
+		if _, ok := seen[tagID]; ok {
+			continue
+		}
+		seen[tagID] = struct{}{}
+
+		if _, ok := tagIDCache.Get(strconv.FormatInt(tagID, 10)); !ok {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "not found tag that has the given id: "+strconv.FormatInt(tagID, 10))
+		}
+		validated = append(validated, tagID)
+	}
+	if len(validated) > maxLivestreamTags {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "too many tags: up to "+strconv.Itoa(maxLivestreamTags))
+	}
+	return validated, nil
+}
+
+func replaceLivestreamTags(ctx context.Context, tx *sqlx.Tx, livestreamID int64, tagIDs []int64) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+	}
+	if len(tagIDs) == 0 {
+		return nil
+	}
+
+	livestreamTags := make([]LivestreamTagModel, len(tagIDs))
+	for i, tagID := range tagIDs {
+		livestreamTags[i] = LivestreamTagModel{
+			LivestreamID: livestreamID,
+			TagID:        tagID,
+		}
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", livestreamTags); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tags: "+err.Error())
+	}
+	return nil
+}
+
+// 配信のタグ置き換えAPI
+// PUT /api/livestream/:livestream_id/tags
+func putLivestreamTagsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *PutLivestreamTagsRequest
+	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	tagIDs, err := validateLivestreamTagIDs(req.Tags)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, livestreamID, userID)
+	if err != nil {
+		return err
+	}
+	switch livestreamModel.EffectiveStatus(time.Now().Unix()) {
+	case livestreamStatusEnded, livestreamStatusCancelled:
+		return echo.NewHTTPError(http.StatusBadRequest, "can't update a livestream that has ended or been cancelled")
+	}
+
+	if err := replaceLivestreamTags(ctx, tx, livestreamModel.ID, tagIDs); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET sequence = sequence + 1 WHERE id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+	// fillLivestreamResponseがコミット前のタグをキャッシュするので、トランザクションを終えてからも消す
+	livestreamTagsCache.Delete(livestreamModel.ID)
+	defer livestreamTagsCache.Delete(livestreamModel.ID)
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	livestreamCache.Delete(livestreamID)
+
+	// 他ノードのキャッシュにも古いタグが残らないようにする
+	// このノードのキャッシュは消してあるので、応答は待たない
+	go purgeCacheAfterCommit(ctx, CachePurgeRequest{LivestreamIDs: []int64{livestreamModel.ID}})
+
+	return c.JSON(http.StatusOK, livestream)
+}
@@ -13,6 +13,7 @@ import (
 	"os/exec"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/go-json-experiment/json"
 	"github.com/go-sql-driver/mysql"
@@ -232,6 +233,10 @@ func initializeSlaveHandler(c echo.Context) error {
 	livestreamCache = sync.Map{}
 	userNameIconCache = sync.Map{}
 	livestreamTagsCache = sync.Map{}
+	userRestrictionCache = sync.Map{}
+	livestreamCollaboratorsCache = sync.Map{}
+	takeoutJobs = sync.Map{}
+	takeoutUserJobs = sync.Map{}
 	cacheLock.Unlock()
 
 	ctx := c.Request().Context()
@@ -239,6 +244,17 @@ func initializeSlaveHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reset tag cache: "+err.Error())
 	}
 
+	// iconsは空になっているので、初期化前に保存されたアイコン画像を消す
+	cutoff := time.Now()
+	go func() {
+		result, err := collectIconGarbage(context.Background(), cutoff)
+		if err != nil {
+			log.Printf("failed to collect icon garbage: %v", err)
+			return
+		}
+		log.Printf("icon gc: scanned=%d deleted=%d reclaimed=%dbytes", result.ScannedFiles, result.DeletedFiles, result.ReclaimedBytes)
+	}()
+
 	return c.NoContent(http.StatusNoContent)
 }
 
@@ -287,12 +303,39 @@ func main() {
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	e.POST("/api/livestream/reservation/recurring", reserveRecurringLivestreamHandler)
+	e.PATCH("/api/livestream/series/:series_id", updateLivestreamSeriesHandler)
+	e.DELETE("/api/livestream/series/:series_id", cancelLivestreamSeriesHandler)
+	// reservation slot availability
+	e.GET("/api/reservation/slots", getReservationSlotsHandler)
+	e.GET("/api/reservation/windows", getReservationWindowsHandler)
+	// (管理者向け)予約枠の生成
+	e.POST("/api/admin/reservation/slots", postAdminReservationSlotsHandler)
+	// (管理者向け)タグ管理
+	e.POST("/api/admin/tag", postAdminTagHandler)
+	e.PUT("/api/admin/tag/:tag_id", putAdminTagHandler)
+	e.DELETE("/api/admin/tag/:tag_id", deleteAdminTagHandler)
+	e.POST("/api/admin/tag/:tag_id/merge", mergeAdminTagHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	e.GET("/api/livestream/recommended", getRecommendedLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
+	e.GET("/api/livestream/following", getFollowingLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
+	e.GET("/api/user/:username/livestream.ics", getUserLivestreamsICalHandler)
+	e.GET("/api/livestream/following.ics", getFollowingLivestreamsICalHandler)
+	e.GET("/api/user/me/ical_token", getICalTokenHandler)
+	e.POST("/api/user/me/ical_token", postICalTokenHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	e.PATCH("/api/livestream/:livestream_id", updateLivestreamHandler)
+	e.DELETE("/api/livestream/:livestream_id", cancelLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/start", startLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/end", endLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/cancel", cancelLivestreamHandler)
+	e.PUT("/api/livestream/:livestream_id/tags", putLivestreamTagsHandler)
+	e.GET("/api/livestream/:livestream_id/thumbnail", getLivestreamThumbnailHandler)
+	e.POST("/api/livestream/:livestream_id/thumbnail", postLivestreamThumbnailHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
 	// ライブコメント投稿
@@ -308,22 +351,54 @@ func main() {
 	// 配信者によるモデレーション (NGワード登録)
 	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler)
 
+	// コラボレーター
+	e.POST("/api/livestream/:livestream_id/collaborator", inviteCollaboratorHandler)
+	e.POST("/api/livestream/:livestream_id/collaborator/accept", acceptCollaborationHandler)
+	e.POST("/api/livestream/:livestream_id/collaborator/decline", declineCollaborationHandler)
+	e.DELETE("/api/livestream/:livestream_id/collaborator/:username", removeCollaboratorHandler)
+	e.GET("/api/user/me/collaboration/invitations", getCollaborationInvitationsHandler)
+
 	// livestream_viewersにINSERTするため必要
 	// ユーザ視聴開始 (viewer)
 	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
+	e.POST("/api/livestream/:livestream_id/heartbeat", heartbeatLivestreamHandler)
 	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
 
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
 	e.GET("/api/user/me", getMeHandler)
+	// 個人データエクスポート
+	e.POST("/api/user/me/takeout", postTakeoutHandler)
+	e.GET("/api/user/me/takeout/:takeout_id", getTakeoutHandler)
+	e.GET("/api/user/me/takeout/:takeout_id/download", downloadTakeoutHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
+	e.GET("/api/user/search", searchUsersHandler)
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
+	// フォロー
+	e.POST("/api/user/:username/follow", followUserHandler)
+	e.DELETE("/api/user/:username/follow", unfollowUserHandler)
+	e.GET("/api/user/:username/followers", getFollowersHandler)
+	e.GET("/api/user/:username/following", getFollowingHandler)
+	// ブロック・ミュート・BAN
+	e.POST("/api/user/:username/block", blockUserHandler)
+	e.DELETE("/api/user/:username/block", unblockUserHandler)
+	e.GET("/api/user/me/blocks", getBlocksHandler)
+	e.POST("/api/user/:username/mute", muteUserHandler)
+	e.DELETE("/api/user/:username/mute", unmuteUserHandler)
+	e.GET("/api/user/me/mutes", getMutesHandler)
+	e.POST("/api/user/:username/ban", banUserHandler)
+	e.DELETE("/api/user/:username/ban", unbanUserHandler)
+	e.GET("/api/user/me/bans", getBansHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
 	e.POST("/api/icon", postIconHandler)
 	e.POST("/api/internal/icon", postInternalIconHandler)
+	e.GET("/api/internal/icon/:name", getInternalIconHandler)
+	e.POST("/api/internal/thumbnail", postInternalThumbnailHandler)
+	e.POST("/api/internal/icon/gc", postInternalIconGCHandler)
+	e.POST("/api/internal/cache/purge", postInternalCachePurgeHandler)
 
 	// stats
 	// ライブ配信統計情報
@@ -343,6 +418,30 @@ func main() {
 	defer conn.Close()
 	dbConn = conn
 
+	store, err := newIconStoreFromEnv()
+	if err != nil {
+		e.Logger.Errorf("failed to configure icon store: %v", err)
+		os.Exit(1)
+	}
+	iconStore = store
+	go startIconGC()
+	go startTakeoutCleanup()
+	go startPresencePrune()
+
+	reservationConf, err := newReservationConfigFromEnv()
+	if err != nil {
+		e.Logger.Errorf("failed to configure reservation: %v", err)
+		os.Exit(1)
+	}
+	reservationConfig = reservationConf
+
+	mediaURLConf, err := newMediaURLConfigFromEnv()
+	if err != nil {
+		e.Logger.Errorf("failed to configure media url validation: %v", err)
+		os.Exit(1)
+	}
+	mediaURLConfig = mediaURLConf
+
 	// キャッシュの初期化
 	if err := resetTagCache(context.Background()); err != nil {
 		e.Logger.Errorf("failed to reset tag cache: %v", err)
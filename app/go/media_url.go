@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	mediaAllowedHostsEnvKey = "ISUCON13_MEDIA_ALLOWED_HOSTS"
+	playlistProbeEnvKey     = "ISUCON13_PLAYLIST_PROBE"
+
+	// プレイリスト取得時に読む最大バイト数
+	maxPlaylistProbeBytes = 1 << 20
+)
+
+type MediaURLConfig struct {
+	// playlist_url, thumbnail_urlに使ってよいホスト
+	AllowedHosts map[string]struct{}
+	// 有効にすると予約時にプレイリストを取得してHLSとして読めるか確かめる
+	Probe bool
+}
+
+var mediaURLConfig = MediaURLConfig{
+	AllowedHosts: map[string]struct{}{
+		"media.xiii.isucon.dev": {},
+	},
+}
+
+var playlistProbeClient = &http.Client{
+	Timeout: 5 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		// リダイレクト先も許可したホストに限る
+		if _, err := parseMediaURL(req.URL.String()); err != nil {
+			return err
+		}
+		return nil
+	},
+}
+
+func newMediaURLConfigFromEnv() (MediaURLConfig, error) {
+	conf := mediaURLConfig
+
+	if v, ok := os.LookupEnv(mediaAllowedHostsEnvKey); ok {
+		conf.AllowedHosts = map[string]struct{}{}
+		for _, host := range strings.Split(v, ",") {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				conf.AllowedHosts[host] = struct{}{}
+			}
+		}
+		if len(conf.AllowedHosts) == 0 {
+			return MediaURLConfig{}, fmt.Errorf("environment variable '%s' must contain at least one host", mediaAllowedHostsEnvKey)
+		}
+	}
+	if v, ok := os.LookupEnv(playlistProbeEnvKey); ok {
+		probe, err := strconv.ParseBool(v)
+		if err != nil {
+			return MediaURLConfig{}, fmt.Errorf("environment variable '%s' must be boolean", playlistProbeEnvKey)
+		}
+		conf.Probe = probe
+	}
+
+	return conf, nil
+}
+
+func parseMediaURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return nil, errors.New("must be an absolute URL")
+	}
+	if u.Scheme != "https" {
+		return nil, errors.New("must use https")
+	}
+	if u.User != nil {
+		return nil, errors.New("must not contain user info")
+	}
+	if _, ok := mediaURLConfig.AllowedHosts[strings.ToLower(u.Hostname())]; !ok {
+		return nil, fmt.Errorf("host %q is not allowed", u.Hostname())
+	}
+	return u, nil
+}
+
+// getLivestreamThumbnailURLが返す、アップロードされたサムネイルのパス
+var livestreamThumbnailPathPattern = regexp.MustCompile(`^/api/livestream/[0-9]+/thumbnail$`)
+
+// 取得したthumbnail_urlをそのまま送り返されたときは、アップロード済みのサムネイルを使い続ける
+func isLivestreamThumbnailPath(s string) bool {
+	return livestreamThumbnailPathPattern.MatchString(s)
+}
+
+// 空ならサムネイルを後からアップロードするものとして受け付ける
+func validateThumbnailURL(s string) error {
+	if s == "" || isLivestreamThumbnailPath(s) {
+		return nil
+	}
+	if _, err := parseMediaURL(s); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid thumbnail_url: "+err.Error())
+	}
+	return nil
+}
+
+func validatePlaylistURL(ctx context.Context, s string) error {
+	u, err := parseMediaURL(s)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid playlist_url: "+err.Error())
+	}
+	if !mediaURLConfig.Probe {
+		return nil
+	}
+	if err := probeHLSPlaylist(ctx, u); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid playlist_url: "+err.Error())
+	}
+	return nil
+}
+
+// 予約・更新リクエストに含まれるURLをまとめて検証する
+func validateMediaURLs(ctx context.Context, playlistURL, thumbnailURL string) error {
+	if err := validatePlaylistURL(ctx, playlistURL); err != nil {
+		return err
+	}
+	if isLivestreamThumbnailPath(thumbnailURL) {
+		// 予約前の配信にはアップロードされたサムネイルがない
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid thumbnail_url: must be uploaded after reserving")
+	}
+	return validateThumbnailURL(thumbnailURL)
+}
+
+// プレイリストを取得し、HLSのマスタープレイリストかメディアプレイリストとして読めるか確かめる
+// RFC 8216 4.3.1.1
+func probeHLSPlaylist(ctx context.Context, u *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := playlistProbeClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch playlist: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch playlist: %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxPlaylistProbeBytes))
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			if strings.TrimPrefix(line, "\ufeff") != "#EXTM3U" {
+				return errors.New("playlist must start with #EXTM3U")
+			}
+			first = false
+			continue
+		}
+		// マスタープレイリストならバリアント、メディアプレイリストならセグメントがあるはず
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") || strings.HasPrefix(line, "#EXTINF:") {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read playlist: %w", err)
+	}
+	if first {
+		return errors.New("playlist is empty")
+	}
+	return errors.New("playlist has neither variant streams nor media segments")
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestValidateThumbnailURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"", true},
+		{"https://media.xiii.isucon.dev/thumb.jpg", true},
+		{"/api/livestream/1/thumbnail", true},
+		{"/api/livestream/123/thumbnail", true},
+		{"http://media.xiii.isucon.dev/thumb.jpg", false},
+		{"https://example.com/thumb.jpg", false},
+		{"/api/livestream/abc/thumbnail", false},
+		{"/api/livestream/1/thumbnail?width=320", false},
+		{"//media.xiii.isucon.dev/thumb.jpg", false},
+	}
+	for _, tt := range tests {
+		if got := validateThumbnailURL(tt.url) == nil; got != tt.want {
+			t.Errorf("validateThumbnailURL(%q) accepted = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
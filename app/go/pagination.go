@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/base64"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/go-json-experiment/json"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+	// 従来の呼び出しでlimitを省略したときの件数。以前と同じく実質的に絞らない
+	unlimitedPageLimit = math.MaxInt32
+)
+
+// 一覧APIのレスポンス
+// 続きがある場合、次のページを取得するためのcursorをnext_cursorで返す
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// クライアントからは中身を見せないページ位置
+// 直前のページ末尾のIDと、id以外の順で並ぶ一覧ではその並び順のキーを持つ
+// 件数で位置を表すと、ページの間に挿入された行の分だけ重複や抜けが出るので使わない
+type pageCursor struct {
+	LastID  int64   `json:"last_id,omitempty"`
+	StartAt int64   `json:"start_at,omitempty"`
+	Score   float64 `json:"score,omitempty"`
+	Match   int     `json:"match,omitempty"`
+}
+
+func encodePageCursor(cursor pageCursor) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePageCursor(s string) (pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, err
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(b, &cursor); err != nil {
+		return pageCursor{}, err
+	}
+	if cursor.LastID < 0 {
+		return pageCursor{}, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+	}
+	return cursor, nil
+}
+
+// limit, cursorクエリを検証する
+func parseCursorPagination(c echo.Context) (int, pageCursor, error) {
+	limit := defaultPageLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > maxPageLimit {
+			return 0, pageCursor{}, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer between 1 and "+strconv.Itoa(maxPageLimit))
+		}
+		limit = l
+	}
+
+	var cursor pageCursor
+	if v := c.QueryParam("cursor"); v != "" {
+		cur, err := decodePageCursor(v)
+		if err != nil {
+			return 0, pageCursor{}, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+		cursor = cur
+	}
+
+	return limit, cursor, nil
+}
+
+// 以前から配列を返していた一覧APIのlimit, cursorクエリを検証する
+// cursorクエリが無ければ従来の呼び出しとみなしてlegacyを返す。その場合は以前と同じく、
+// limitを省略すると件数を絞らず、レスポンスもPageに包まない配列のままにする
+// ページ送りしたいクライアントは、最初のページを空のcursorクエリ付きで取得する
+func parseLegacyCompatiblePagination(c echo.Context) (int, pageCursor, bool, error) {
+	if _, ok := c.QueryParams()["cursor"]; !ok {
+		if c.QueryParam("limit") == "" {
+			return unlimitedPageLimit, pageCursor{}, true, nil
+		}
+		limit, _, err := parseCursorPagination(c)
+		return limit, pageCursor{}, true, err
+	}
+	limit, cursor, err := parseCursorPagination(c)
+	return limit, cursor, false, err
+}
+
+// legacyなら配列のまま、そうでなければPageに包んで返す
+func respondPage[T any](c echo.Context, legacy bool, items []T, nextCursor string) error {
+	if legacy {
+		return c.JSON(http.StatusOK, items)
+	}
+	return c.JSON(http.StatusOK, Page[T]{Items: items, NextCursor: nextCursor})
+}
+
+// limit+1件取得した結果をlimit件に切り詰め、続きがあるかを返す
+func trimPage[T any](rows []T, limit int) ([]T, bool) {
+	if len(rows) > limit {
+		return rows[:limit], true
+	}
+	return rows, false
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 最後のハートビートからこの時間が経った視聴者は離脱したものとみなす
+	presenceTTL = 60 * time.Second
+	// クライアントに案内するハートビートの間隔
+	heartbeatInterval = 20 * time.Second
+
+	// 離脱した視聴者の行を残しておく期間
+	presenceRetention     = 1 * time.Hour
+	presencePruneInterval = 10 * time.Minute
+	// 一度に削除する行数。行ロックを長く持たないよう分けて削除する
+	presencePruneBatchSize = 1000
+)
+
+type HeartbeatResponse struct {
+	ViewersCount int64 `json:"viewers_count"`
+	// 次のハートビートまでの秒数
+	HeartbeatInterval int64 `json:"heartbeat_interval"`
+}
+
+// 視聴中であることを記録する。この配信に対する行が無く、新しく作った場合はtrueを返す
+func touchPresence(ctx context.Context, tx *sqlx.Tx, livestreamID, userID int64, now time.Time) (bool, error) {
+	rs, err := tx.ExecContext(ctx, "INSERT INTO livestream_presences (livestream_id, user_id, last_seen_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE last_seen_at = VALUES(last_seen_at)", livestreamID, userID, now.Unix())
+	if err != nil {
+		return false, err
+	}
+	// ON DUPLICATE KEY UPDATEは挿入なら1、更新なら2(値が同じなら0)を返す
+	n, err := rs.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// 現在の同時視聴者数を数え、最大同時視聴者数を更新する
+// 他の視聴者のコミット済みの行が見えるよう、touchPresenceのトランザクションをコミットしてから呼ぶ
+// 最大値は条件付きの更新で上げるだけなので、同じ配信のハートビート同士でロックを待ち合わせない
+func updateViewerPeak(ctx context.Context, livestreamID int64, now time.Time) (int64, error) {
+	var current int64
+	if err := dbConn.GetContext(ctx, &current, "SELECT COUNT(*) FROM livestream_presences WHERE livestream_id = ? AND last_seen_at > ?", livestreamID, now.Add(-presenceTTL).Unix()); err != nil {
+		return 0, err
+	}
+	// peaked_atは更新前のpeak_viewersと比べるので先に代入する
+	if _, err := dbConn.ExecContext(ctx, `
+		INSERT INTO livestream_viewer_peaks (livestream_id, peak_viewers, peaked_at) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			peaked_at = IF(VALUES(peak_viewers) > peak_viewers, VALUES(peaked_at), peaked_at),
+			peak_viewers = GREATEST(peak_viewers, VALUES(peak_viewers))
+		`, livestreamID, current, now.Unix()); err != nil {
+		return 0, err
+	}
+	return current, nil
+}
+
+// 一度も入室していない視聴者がハートビートだけを送ってきても、ユニーク視聴者数に数えられるよう視聴履歴を残す
+func insertViewerHistory(ctx context.Context, tx *sqlx.Tx, livestreamID, userID int64, now time.Time) error {
+	_, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", LivestreamViewerModel{
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		CreatedAt:    now.Unix(),
+	})
+	return err
+}
+
+// 視聴継続API
+// 視聴中のクライアントはheartbeat_intervalごとに呼ぶ
+// POST /api/livestream/:livestream_id/heartbeat
+func heartbeatLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	switch livestreamModel.EffectiveStatus(time.Now().Unix()) {
+	case livestreamStatusEnded, livestreamStatusCancelled:
+		return echo.NewHTTPError(http.StatusBadRequest, "can't watch a livestream that has ended or been cancelled")
+	}
+
+	// 期限切れの後に再開した場合は入室と同じ扱いになるので、BANも確認する
+	banned, err := isBannedByStreamer(ctx, tx, livestreamModel.UserID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user restrictions: "+err.Error())
+	}
+	if banned {
+		return echo.NewHTTPError(http.StatusForbidden, "you are banned from this streamer's livestreams")
+	}
+
+	now := time.Now()
+	created, err := touchPresence(ctx, tx, livestreamModel.ID, userID, now)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream presence: "+err.Error())
+	}
+	if created {
+		if err := insertViewerHistory(ctx, tx, livestreamModel.ID, userID, now); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	viewersCount, err := updateViewerPeak(ctx, livestreamModel.ID, now)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update peak viewers: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, HeartbeatResponse{
+		ViewersCount:      viewersCount,
+		HeartbeatInterval: int64(heartbeatInterval / time.Second),
+	})
+}
+
+// 現在の同時視聴者数
+func calcCurrentViewerCount(tx *sqlx.Tx, ctx context.Context, livestreamID int64, now time.Time) (int64, error) {
+	var viewersCount int64
+	if err := tx.GetContext(ctx, &viewersCount, "SELECT COUNT(*) FROM livestream_presences WHERE livestream_id = ? AND last_seen_at > ?", livestreamID, now.Add(-presenceTTL).Unix()); err != nil {
+		return 0, err
+	}
+	return viewersCount, nil
+}
+
+// 最大同時視聴者数
+func calcPeakViewerCount(tx *sqlx.Tx, ctx context.Context, livestreamID int64) (int64, error) {
+	var peakViewers int64
+	if err := tx.GetContext(ctx, &peakViewers, "SELECT peak_viewers FROM livestream_viewer_peaks WHERE livestream_id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	return peakViewers, nil
+}
+
+// 一度でも入室したことのある視聴者数
+func calcUniqueViewerCount(tx *sqlx.Tx, ctx context.Context, livestreamID int64) (int64, error) {
+	var uniqueViewers int64
+	if err := tx.GetContext(ctx, &uniqueViewers, "SELECT COUNT(DISTINCT user_id) FROM livestream_viewers_history WHERE livestream_id = ?", livestreamID); err != nil {
+		return 0, err
+	}
+	return uniqueViewers, nil
+}
+
+func startPresencePrune() {
+	ticker := time.NewTicker(presencePruneInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if deleted, err := pruneStalePresences(context.Background(), time.Now()); err != nil {
+			log.Printf("failed to prune stale presences: %v", err)
+		} else if deleted > 0 {
+			log.Printf("presence prune: deleted=%d", deleted)
+		}
+	}
+}
+
+// 離脱してからpresenceRetentionを過ぎた視聴者の行を削除する
+// 視聴したことはlivestream_viewers_historyに残っている
+func pruneStalePresences(ctx context.Context, now time.Time) (int64, error) {
+	var deleted int64
+	for {
+		rs, err := dbConn.ExecContext(ctx, "DELETE FROM livestream_presences WHERE last_seen_at < ? LIMIT ?", now.Add(-presenceRetention).Unix(), presencePruneBatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := rs.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+		if n < presencePruneBatchSize {
+			return deleted, nil
+		}
+	}
+}
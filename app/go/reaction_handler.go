@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -61,19 +60,49 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
 	}
 
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit, cursor, legacy, err := parseLegacyCompatiblePagination(c)
+	if err != nil {
+		return err
+	}
+
+	// ブロック・ミュートしているユーザのリアクションは表示しない
+	hiddenUserIDs, err := getHiddenUserIDs(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user restrictions: "+err.Error())
+	}
+
+	query := "SELECT * FROM reactions WHERE livestream_id = ?"
+	args := []interface{}{livestreamID}
+	if len(hiddenUserIDs) > 0 {
+		query += " AND user_id NOT IN (?)"
+		args = append(args, hiddenUserIDs)
+	}
+	if cursor.LastID > 0 {
+		query += " AND id < ?"
+		args = append(args, cursor.LastID)
+	}
+	// 続きがあるかを知るために1件多く取得する
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit+1)
+	query, args, err = sqlx.In(query, args...)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
 	}
 
 	reactionModels := []ReactionModel{}
-	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &reactionModels, query, args...); err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
 	}
+	reactionModels, hasNext := trimPage(reactionModels, limit)
+	var nextCursor string
+	if hasNext {
+		nextCursor = encodePageCursor(pageCursor{LastID: reactionModels[len(reactionModels)-1].ID})
+	}
 
 	reactions := make([]Reaction, len(reactionModels))
 	for i := range reactionModels {
@@ -89,7 +118,7 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, reactions)
+	return respondPage(c, legacy, reactions, nextCursor)
 }
 
 func postReactionHandler(c echo.Context) error {
@@ -120,6 +149,19 @@ func postReactionHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+	}
+
+	banned, err := isBannedByStreamer(ctx, tx, livestreamModel.UserID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user restrictions: "+err.Error())
+	}
+	if banned {
+		return echo.NewHTTPError(http.StatusForbidden, "you are banned from this streamer's livestreams")
+	}
+
 	reactionModel := ReactionModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
@@ -138,10 +180,6 @@ func postReactionHandler(c echo.Context) error {
 	}
 	reactionModel.ID = reactionID
 
-	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
-	}
 	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
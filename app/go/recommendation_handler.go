@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// おすすめ度のうち、タグの好みが占める割合
+	// 残りは人気度(ランキングと同じリアクション数+チップ合計)で決める
+	recommendTagAffinityRatio = 0.7
+
+	// 視聴・コメント・リアクションした配信のタグをどれだけ重視するか
+	recommendViewWeight     = 1
+	recommendCommentWeight  = 2
+	recommendReactionWeight = 1
+)
+
+type recommendCandidate struct {
+	ID       int64
+	Affinity float64
+	Score    float64
+}
+
+// おすすめ配信取得API
+// GET /api/livestream/recommended?limit=&cursor=
+func getRecommendedLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit, cursor, err := parseCursorPagination(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	ranked, err := rankRecommendedLivestreams(ctx, tx, userID, time.Now().Unix())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to rank livestreams: "+err.Error())
+	}
+
+	// 直前のページ末尾の(おすすめ度, ID)より後ろから返す
+	if cursor.LastID > 0 {
+		ranked = ranked[sort.Search(len(ranked), func(i int) bool {
+			return ranked[i].Score < cursor.Score || (ranked[i].Score == cursor.Score && ranked[i].ID < cursor.LastID)
+		}):]
+	}
+	ranked, hasNext := trimPage(ranked, limit)
+	var nextCursor string
+	if hasNext {
+		last := ranked[len(ranked)-1]
+		nextCursor = encodePageCursor(pageCursor{LastID: last.ID, Score: last.Score})
+	}
+
+	livestreams := make([]Livestream, len(ranked))
+	for i := range ranked {
+		livestreamModel, err := getLivestream(ctx, tx, int(ranked[i].ID))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+		livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, Page[Livestream]{Items: livestreams, NextCursor: nextCursor})
+}
+
+// まだ終わっていない他人の配信を、おすすめ度の高い順に並べる
+func rankRecommendedLivestreams(ctx context.Context, tx *sqlx.Tx, userID int64, now int64) ([]recommendCandidate, error) {
+	tagWeights, err := getTagAffinity(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	scheduledCond, scheduledArgs, err := livestreamStatusCondition(livestreamStatusScheduled, now)
+	if err != nil {
+		return nil, err
+	}
+	liveCond, liveArgs, err := livestreamStatusCondition(livestreamStatusLive, now)
+	if err != nil {
+		return nil, err
+	}
+	args := append([]any{userID}, scheduledArgs...)
+	args = append(args, liveArgs...)
+	var candidateIDs []int64
+	if err := tx.SelectContext(ctx, &candidateIDs, "SELECT ls.id FROM livestreams ls WHERE ls.user_id != ? AND ("+scheduledCond+" OR "+liveCond+")", args...); err != nil {
+		return nil, err
+	}
+	if len(candidateIDs) == 0 {
+		return []recommendCandidate{}, nil
+	}
+
+	candidates := make(map[int64]*recommendCandidate, len(candidateIDs))
+	for _, id := range candidateIDs {
+		candidates[id] = &recommendCandidate{ID: id}
+	}
+
+	if len(tagWeights) > 0 {
+		var livestreamTags []LivestreamTagModel
+		query, params, err := sqlx.In("SELECT livestream_id, tag_id FROM livestream_tags WHERE livestream_id IN (?)", candidateIDs)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.SelectContext(ctx, &livestreamTags, query, params...); err != nil {
+			return nil, err
+		}
+		for _, lt := range livestreamTags {
+			candidates[lt.LivestreamID].Affinity += tagWeights[lt.TagID]
+		}
+	}
+
+	popularity, err := getLivestreamPopularity(ctx, tx, candidateIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// どちらも最大値で割って0〜1に揃えてから混ぜる
+	var maxAffinity, maxPopularity float64
+	for _, candidate := range candidates {
+		maxAffinity = max(maxAffinity, candidate.Affinity)
+		maxPopularity = max(maxPopularity, float64(popularity[candidate.ID]))
+	}
+	ranked := make([]recommendCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if maxAffinity > 0 {
+			candidate.Score += recommendTagAffinityRatio * candidate.Affinity / maxAffinity
+		}
+		if maxPopularity > 0 {
+			candidate.Score += (1 - recommendTagAffinityRatio) * float64(popularity[candidate.ID]) / maxPopularity
+		}
+		ranked = append(ranked, *candidate)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score == ranked[j].Score {
+			return ranked[i].ID > ranked[j].ID
+		}
+		return ranked[i].Score > ranked[j].Score
+	})
+	return ranked, nil
+}
+
+// ユーザが視聴・コメント・リアクションした配信のタグごとの重み
+func getTagAffinity(ctx context.Context, tx *sqlx.Tx, userID int64) (map[int64]float64, error) {
+	var rows []struct {
+		TagID  int64   `db:"tag_id"`
+		Weight float64 `db:"weight"`
+	}
+	query := `
+		SELECT lt.tag_id, SUM(i.weight) AS weight FROM (
+			SELECT DISTINCT livestream_id, ? AS weight FROM livestream_viewers_history WHERE user_id = ?
+			UNION ALL
+			SELECT DISTINCT livestream_id, ? AS weight FROM livecomments WHERE user_id = ?
+			UNION ALL
+			SELECT DISTINCT livestream_id, ? AS weight FROM reactions WHERE user_id = ?
+		) i
+		INNER JOIN livestream_tags lt ON lt.livestream_id = i.livestream_id
+		GROUP BY lt.tag_id
+		`
+	if err := tx.SelectContext(ctx, &rows, query,
+		recommendViewWeight, userID,
+		recommendCommentWeight, userID,
+		recommendReactionWeight, userID,
+	); err != nil {
+		return nil, err
+	}
+
+	tagWeights := make(map[int64]float64, len(rows))
+	for _, row := range rows {
+		tagWeights[row.TagID] = row.Weight
+	}
+	return tagWeights, nil
+}
+
+// 配信ランキングと同じく、リアクション数とチップ合計の和を人気度とする
+func getLivestreamPopularity(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64) (map[int64]int64, error) {
+	var rows []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Score        int64 `db:"score"`
+	}
+	query, params, err := sqlx.In(`
+		SELECT livestream_id, SUM(score) AS score FROM (
+			SELECT livestream_id, COUNT(*) AS score FROM reactions WHERE livestream_id IN (?) GROUP BY livestream_id
+			UNION ALL
+			SELECT livestream_id, IFNULL(SUM(tip), 0) AS score FROM livecomments WHERE livestream_id IN (?) GROUP BY livestream_id
+		) s
+		GROUP BY livestream_id
+		`, livestreamIDs, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &rows, query, params...); err != nil {
+		return nil, err
+	}
+
+	popularity := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		popularity[row.LivestreamID] = row.Score
+	}
+	return popularity, nil
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	reservationSlotOriginEnvKey    = "ISUCON13_RESERVATION_SLOT_ORIGIN"
+	reservationSlotSecondsEnvKey   = "ISUCON13_RESERVATION_SLOT_SECONDS"
+	reservationSlotCapacityEnvKey  = "ISUCON13_RESERVATION_SLOT_CAPACITY"
+	reservationOverlapPolicyEnvKey = "ISUCON13_RESERVATION_OVERLAP_POLICY"
+
+	// 予約枠の生成で一度に作る枠数の上限
+	maxGeneratedReservationSlots = 24 * 366
+)
+
+// 予約できる期間は設定では決めず、管理者が作った予約枠があるところとする
+type ReservationConfig struct {
+	// 予約枠の境界の基準時刻。予約枠はここから枠の長さ単位で区切る
+	SlotOrigin time.Time
+	// 予約枠1つあたりの長さ(秒)
+	SlotSeconds int64
+	// 予約枠1つあたりの同時予約可能数
+	SlotCapacity int64
+	// 同じ配信者の配信が重なる予約の扱い
+	OverlapPolicy string
+}
+
+// デフォルトは毎時0分区切りで1時間ごとに5枠
+// 配信の重なりは警告のみ
+var reservationConfig = ReservationConfig{
+	SlotOrigin:    time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC),
+	SlotSeconds:   60 * 60,
+	SlotCapacity:  5,
+	OverlapPolicy: overlapPolicyWarn,
+}
+
+// 時刻はUNIX秒またはRFC3339で指定する
+func parseReservationTime(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func newReservationConfigFromEnv() (ReservationConfig, error) {
+	conf := reservationConfig
+
+	if v, ok := os.LookupEnv(reservationSlotOriginEnvKey); ok {
+		t, err := parseReservationTime(v)
+		if err != nil {
+			return ReservationConfig{}, fmt.Errorf("failed to parse environment variable '%s': %w", reservationSlotOriginEnvKey, err)
+		}
+		conf.SlotOrigin = t
+	}
+	if v, ok := os.LookupEnv(reservationSlotSecondsEnvKey); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return ReservationConfig{}, fmt.Errorf("environment variable '%s' must be positive integer", reservationSlotSecondsEnvKey)
+		}
+		conf.SlotSeconds = n
+	}
+	if v, ok := os.LookupEnv(reservationSlotCapacityEnvKey); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return ReservationConfig{}, fmt.Errorf("environment variable '%s' must be positive integer", reservationSlotCapacityEnvKey)
+		}
+		conf.SlotCapacity = n
+	}
+
+	if v, ok := os.LookupEnv(reservationOverlapPolicyEnvKey); ok {
+		switch v {
+		case overlapPolicyReject, overlapPolicyWarn, overlapPolicyAllow:
+			conf.OverlapPolicy = v
+		default:
+			return ReservationConfig{}, fmt.Errorf("environment variable '%s' must be one of reject, warn or allow", reservationOverlapPolicyEnvKey)
+		}
+	}
+
+	return conf, nil
+}
+
+type UpdateLivestreamRequest struct {
+	Title        *string `json:"title"`
+	Description  *string `json:"description"`
+	PlaylistUrl  *string `json:"playlist_url"`
+	ThumbnailUrl *string `json:"thumbnail_url"`
+	StartAt      *int64  `json:"start_at"`
+	EndAt        *int64  `json:"end_at"`
+}
+
+// 予約区間をチェック
+// 予約期間内であるかは、予約枠がすき間なく存在するかでtakeReservationSlotsが確かめる
+func validateReservationTerm(startAt, endAt int64) error {
+	if startAt >= endAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at must be before end_at")
+	}
+	return nil
+}
+
+// 予約枠の境界に切り上げる
+func ceilReservationSlotBoundary(t int64) int64 {
+	offset := (t - reservationConfig.SlotOrigin.Unix()) % reservationConfig.SlotSeconds
+	if offset < 0 {
+		offset += reservationConfig.SlotSeconds
+	}
+	if offset > 0 {
+		t += reservationConfig.SlotSeconds - offset
+	}
+	return t
+}
+
+// start_at順に並んだ予約枠が予約区間をすき間なく覆っているか
+func coversReservationRange(slots []*ReservationSlotModel, startAt, endAt int64) bool {
+	if len(slots) == 0 {
+		return false
+	}
+	if slots[0].StartAt != startAt || slots[len(slots)-1].EndAt != endAt {
+		return false
+	}
+	for i := 1; i < len(slots); i++ {
+		if slots[i-1].EndAt != slots[i].StartAt {
+			return false
+		}
+	}
+	return true
+}
+
+// 予約区間の予約枠を1つずつ確保する
+func takeReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
+	var slots []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at FOR UPDATE", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	if !coversReservationRange(slots, startAt, endAt) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約区間 %d ~ %dが予約枠と一致しません", startAt, endAt))
+	}
+
+	slotIDs := make([]int64, len(slots))
+	for i, slot := range slots {
+		if slot.Slot < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約区間 %d ~ %dに空きのない予約枠があり予約できません", startAt, endAt))
+		}
+		slotIDs[i] = slot.ID
+	}
+
+	query, args, err := sqlx.In("UPDATE reservation_slots SET slot = slot - 1 WHERE id IN (?)", slotIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	return nil
+}
+
+// 予約区間の予約枠を1つずつ返却する
+func releaseReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	return nil
+}
+
+// 配信者自身の配信を排他ロックを取って取得する
+func getOwnedLivestreamForUpdate(ctx context.Context, tx *sqlx.Tx, livestreamID int, userID int64) (LivestreamModel, error) {
+	livestreamModel := LivestreamModel{}
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusForbidden, "can't modify other streamer's livestream")
+	}
+	return livestreamModel, nil
+}
+
+// 予約枠を返却して配信予約をキャンセル済みにする
+// 配信自体は履歴として残す
+func cancelReservedLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) error {
+	if err := releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET status = ?, sequence = sequence + 1 WHERE id = ?", livestreamStatusCancelled, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+	return nil
+}
+
+// 配信予約の更新API
+// PATCH /api/livestream/:livestream_id
+func updateLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *UpdateLivestreamRequest
+	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.PlaylistUrl != nil {
+		if err := validatePlaylistURL(ctx, *req.PlaylistUrl); err != nil {
+			return err
+		}
+	}
+	if req.ThumbnailUrl != nil {
+		if err := validateThumbnailURL(*req.ThumbnailUrl); err != nil {
+			return err
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, livestreamID, userID)
+	if err != nil {
+		return err
+	}
+	switch livestreamModel.EffectiveStatus(time.Now().Unix()) {
+	case livestreamStatusEnded, livestreamStatusCancelled:
+		return echo.NewHTTPError(http.StatusBadRequest, "can't update a livestream that has ended or been cancelled")
+	}
+
+	if req.Title != nil {
+		livestreamModel.Title = *req.Title
+	}
+	if req.Description != nil {
+		livestreamModel.Description = *req.Description
+	}
+	if req.PlaylistUrl != nil {
+		livestreamModel.PlaylistUrl = *req.PlaylistUrl
+	}
+	if req.ThumbnailUrl != nil && isLivestreamThumbnailPath(*req.ThumbnailUrl) {
+		if *req.ThumbnailUrl != getLivestreamThumbnailURL(livestreamModel) {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid thumbnail_url: must be the thumbnail of this livestream")
+		}
+	} else if req.ThumbnailUrl != nil {
+		livestreamModel.ThumbnailUrl = *req.ThumbnailUrl
+		livestreamModel.ThumbnailHash = ""
+	}
+
+	var overlappingIDs []int64
+	startAt, endAt := livestreamModel.StartAt, livestreamModel.EndAt
+	if req.StartAt != nil {
+		startAt = *req.StartAt
+	}
+	if req.EndAt != nil {
+		endAt = *req.EndAt
+	}
+	if startAt != livestreamModel.StartAt || endAt != livestreamModel.EndAt {
+		if livestreamModel.EffectiveStatus(time.Now().Unix()) != livestreamStatusScheduled {
+			return echo.NewHTTPError(http.StatusBadRequest, "can't change the time range of a livestream that has already started")
+		}
+		if err := validateReservationTerm(startAt, endAt); err != nil {
+			return err
+		}
+
+		participantIDs, err := getAcceptedCollaboratorIDs(ctx, tx, livestreamModel.ID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+		}
+		participantIDs = append([]int64{livestreamModel.UserID}, participantIDs...)
+		if overlappingIDs, err = checkReservationOverlap(c, tx, participantIDs, startAt, endAt, livestreamModel.ID); err != nil {
+			return err
+		}
+
+		// 旧区間の予約枠を返却してから新区間の予約枠を確保する
+		if err := releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+			return err
+		}
+		if err := takeReservationSlots(ctx, tx, startAt, endAt); err != nil {
+			return err
+		}
+		livestreamModel.StartAt = startAt
+		livestreamModel.EndAt = endAt
+	}
+
+	if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, playlist_url = :playlist_url, thumbnail_url = :thumbnail_url, thumbnail_hash = :thumbnail_hash, start_at = :start_at, end_at = :end_at, sequence = sequence + 1 WHERE id = :id", &livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+	livestream.OverlappingLivestreamIDs = overlappingIDs
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	livestreamCache.Delete(livestreamID)
+	livestreamTagsCache.Delete(livestreamModel.ID)
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// 配信予約のキャンセルAPI
+// DELETE /api/livestream/:livestream_id
+// POST /api/livestream/:livestream_id/cancel
+func cancelLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, livestreamID, userID)
+	if err != nil {
+		return err
+	}
+	if livestreamModel.EffectiveStatus(time.Now().Unix()) != livestreamStatusScheduled {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't cancel a livestream that has already started or been cancelled")
+	}
+
+	if err := cancelReservedLivestream(ctx, tx, livestreamModel); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	livestreamCache.Delete(livestreamID)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+const (
+	// 空き枠一覧で一度に返す予約枠数の上限
+	maxReservationSlotsPerRequest = 24 * 31
+	defaultReservationWindowCount = 5
+	maxReservationWindowCount     = 50
+)
+
+type ReservationSlot struct {
+	StartAt   int64 `json:"start_at"`
+	EndAt     int64 `json:"end_at"`
+	Remaining int64 `json:"remaining"`
+}
+
+type ReservationWindow struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+}
+
+func parseUnixQueryParam(c echo.Context, name string, defaultValue int64) (int64, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+	t, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, name+" query parameter must be integer")
+	}
+	return t, nil
+}
+
+// 予約枠の空き状況API
+// GET /api/reservation/slots?from=&to=
+func getReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	from, err := parseUnixQueryParam(c, "from", time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	to, err := parseUnixQueryParam(c, "to", from+maxReservationSlotsPerRequest*reservationConfig.SlotSeconds)
+	if err != nil {
+		return err
+	}
+	if from >= to {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+
+	var slotModels []*ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slotModels, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at LIMIT ?", from, to, maxReservationSlotsPerRequest); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	slots := make([]ReservationSlot, len(slotModels))
+	for i, slot := range slotModels {
+		slots[i] = ReservationSlot{
+			StartAt:   slot.StartAt,
+			EndAt:     slot.EndAt,
+			Remaining: max(slot.Slot, 0),
+		}
+	}
+
+	return c.JSON(http.StatusOK, slots)
+}
+
+// 予約可能な区間の検索API
+// GET /api/reservation/windows?duration=&count=&from=
+func getReservationWindowsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	duration, err := parseUnixQueryParam(c, "duration", 0)
+	if err != nil {
+		return err
+	}
+	if err := validateReservationWindowDuration(duration); err != nil {
+		return err
+	}
+	count := defaultReservationWindowCount
+	if v := c.QueryParam("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxReservationWindowCount {
+			return echo.NewHTTPError(http.StatusBadRequest, "count query parameter must be integer between 1 and "+strconv.Itoa(maxReservationWindowCount))
+		}
+		count = n
+	}
+	from, err := parseUnixQueryParam(c, "from", time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	var slots []*ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? ORDER BY start_at", from); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, findReservationWindows(slots, duration, count))
+}
+
+// 予約は予約枠の境界でしか取れないので、durationは予約枠の長さの倍数に限る
+func validateReservationWindowDuration(duration int64) error {
+	if duration <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "duration query parameter must be positive integer")
+	}
+	if duration%reservationConfig.SlotSeconds != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "duration query parameter must be a multiple of "+strconv.FormatInt(reservationConfig.SlotSeconds, 10)+" seconds")
+	}
+	return nil
+}
+
+// start_at順に並んだ予約枠から、duration秒の予約が可能な区間を先頭からcount件探す
+func findReservationWindows(slots []*ReservationSlotModel, duration int64, count int) []ReservationWindow {
+	windows := []ReservationWindow{}
+	for i := 0; i < len(slots) && len(windows) < count; i++ {
+		startAt := slots[i].StartAt
+		for j := i; j < len(slots); j++ {
+			if slots[j].Slot < 1 || (j > i && slots[j-1].EndAt != slots[j].StartAt) {
+				break
+			}
+			if slots[j].EndAt-startAt == duration {
+				windows = append(windows, ReservationWindow{StartAt: startAt, EndAt: slots[j].EndAt})
+				break
+			}
+			if slots[j].EndAt-startAt > duration {
+				break
+			}
+		}
+	}
+	return windows
+}
+
+type GenerateReservationSlotsRequest struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	// 省略時は設定値を使う
+	Capacity *int64 `json:"capacity"`
+}
+
+type GenerateReservationSlotsResponse struct {
+	Created int64 `json:"created"`
+	Skipped int64 `json:"skipped"`
+}
+
+// (管理者向け)予約枠の生成API
+// POST /api/admin/reservation/slots
+func postAdminReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req *GenerateReservationSlotsRequest
+	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	slotSeconds := reservationConfig.SlotSeconds
+	capacity := reservationConfig.SlotCapacity
+	if req.Capacity != nil {
+		if *req.Capacity < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "capacity must be non-negative")
+		}
+		capacity = *req.Capacity
+	}
+	if req.StartAt >= req.EndAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at must be before end_at")
+	}
+	// 予約枠を作ったところが新たな予約期間になる
+	// 予約枠の境界は基準時刻から枠の長さ単位で揃える
+	if ceilReservationSlotBoundary(req.StartAt) != req.StartAt || (req.EndAt-req.StartAt)%slotSeconds != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("start_at and end_at must be aligned to %d seconds slots", slotSeconds))
+	}
+	if (req.EndAt-req.StartAt)/slotSeconds > maxGeneratedReservationSlots {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("can't generate more than %d slots at once", maxGeneratedReservationSlots))
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 既存の枠と重なる区間には作らない
+	var existing []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &existing, "SELECT * FROM reservation_slots WHERE start_at < ? AND end_at > ? FOR UPDATE", req.EndAt, req.StartAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	var (
+		slots   []*ReservationSlotModel
+		skipped int64
+	)
+	for startAt := req.StartAt; startAt < req.EndAt; startAt += slotSeconds {
+		endAt := startAt + slotSeconds
+		overlapped := false
+		for _, slot := range existing {
+			if slot.StartAt < endAt && slot.EndAt > startAt {
+				overlapped = true
+				break
+			}
+		}
+		if overlapped {
+			skipped++
+			continue
+		}
+		slots = append(slots, &ReservationSlotModel{
+			Slot:    capacity,
+			StartAt: startAt,
+			EndAt:   endAt,
+		})
+	}
+
+	if len(slots) > 0 {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (:slot, :start_at, :end_at)", slots); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation_slots: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, GenerateReservationSlotsResponse{
+		Created: int64(len(slots)),
+		Skipped: skipped,
+	})
+}
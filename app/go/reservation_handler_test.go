@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"testing/quick"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 並列予約のテストで使うMySQLのスキーマ名。本番のスキーマを壊さないよう、明示的に指定したときだけDBに書き込む
+const reservationTestDatabaseEnvKey = "ISUCON13_TEST_MYSQL_DATABASE"
+
+// startからwidth秒ずつ隙間なく並んだn個の予約枠を作る
+func contiguousSlots(start, width int64, n int, slot int64) []*ReservationSlotModel {
+	slots := make([]*ReservationSlotModel, n)
+	for i := range slots {
+		slots[i] = &ReservationSlotModel{
+			ID:      int64(i + 1),
+			Slot:    slot,
+			StartAt: start + int64(i)*width,
+			EndAt:   start + int64(i+1)*width,
+		}
+	}
+	return slots
+}
+
+func TestCoversReservationRange(t *testing.T) {
+	property := func(start uint32, width uint16, n uint8, drop uint8) bool {
+		w := int64(width) + 1
+		count := int(n%20) + 1
+		slots := contiguousSlots(int64(start), w, count, 1)
+		startAt, endAt := slots[0].StartAt, slots[count-1].EndAt
+
+		// 隙間なく並んでいれば区間全体を覆う
+		if !coversReservationRange(slots, startAt, endAt) {
+			return false
+		}
+		// 区間の端がずれていれば覆わない
+		if coversReservationRange(slots, startAt-1, endAt) || coversReservationRange(slots, startAt, endAt+1) {
+			return false
+		}
+		// 予約枠の途中で終わる区間は覆わない
+		if coversReservationRange(slots, startAt, endAt-w/2-1) {
+			return false
+		}
+		// 途中の予約枠が抜けていれば覆わない
+		if count >= 3 {
+			i := int(drop)%(count-2) + 1
+			gapped := append(append([]*ReservationSlotModel{}, slots[:i]...), slots[i+1:]...)
+			if coversReservationRange(gapped, startAt, endAt) {
+				return false
+			}
+		}
+		return !coversReservationRange(nil, startAt, endAt)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// findReservationWindowsと同じ結果になるはずの素朴な実装
+func naiveReservationWindows(slots []*ReservationSlotModel, duration int64, count int) []ReservationWindow {
+	windows := []ReservationWindow{}
+	for i := range slots {
+		if len(windows) >= count {
+			break
+		}
+		for j := i; j < len(slots); j++ {
+			if slots[j].Slot < 1 || (j > i && slots[j-1].EndAt != slots[j].StartAt) {
+				break
+			}
+			if slots[j].EndAt-slots[i].StartAt == duration {
+				windows = append(windows, ReservationWindow{StartAt: slots[i].StartAt, EndAt: slots[j].EndAt})
+				break
+			}
+		}
+	}
+	return windows
+}
+
+func TestFindReservationWindows(t *testing.T) {
+	property := func(seed int64, n uint8, k uint8, count uint8) bool {
+		r := rand.New(rand.NewSource(seed))
+		const width = 3600
+		duration := int64(k%5+1) * width
+		limit := int(count%10) + 1
+
+		// 空きのない予約枠や、予約枠の抜けをところどころに入れる
+		var slots []*ReservationSlotModel
+		at := int64(0)
+		for i := 0; i < int(n%50); i++ {
+			if r.Intn(8) == 0 {
+				at += width
+			}
+			slots = append(slots, &ReservationSlotModel{ID: int64(i + 1), Slot: int64(r.Intn(3)), StartAt: at, EndAt: at + width})
+			at += width
+		}
+
+		windows := findReservationWindows(slots, duration, limit)
+		if len(windows) > limit {
+			return false
+		}
+		for i, window := range windows {
+			if window.EndAt-window.StartAt != duration {
+				return false
+			}
+			if i > 0 && windows[i-1].StartAt >= window.StartAt {
+				return false
+			}
+		}
+		expected := naiveReservationWindows(slots, duration, limit)
+		if len(windows) != len(expected) {
+			return false
+		}
+		for i := range windows {
+			if windows[i] != expected[i] {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateReservationWindowDuration(t *testing.T) {
+	slotSeconds := reservationConfig.SlotSeconds
+	property := func(k uint8, remainder uint16) bool {
+		whole := int64(k%24+1) * slotSeconds
+		if validateReservationWindowDuration(whole) != nil {
+			return false
+		}
+		// 予約枠の途中で終わる長さは、黙って0件を返すのではなくエラーにする
+		partial := whole + int64(remainder)%(slotSeconds-1) + 1
+		return validateReservationWindowDuration(partial) != nil
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+	if validateReservationWindowDuration(0) == nil || validateReservationWindowDuration(-slotSeconds) == nil {
+		t.Error("non-positive duration must be rejected")
+	}
+}
+
+// 同じ予約枠に対して並列に予約と返却を繰り返しても、残り枠数が0未満にも定員超過にもならないことを確かめる
+// 実際のMySQLに書き込むので、テスト用のスキーマをreservationTestDatabaseEnvKeyで指定したときだけ実行する
+func TestTakeReservationSlotsConcurrently(t *testing.T) {
+	dbName, ok := os.LookupEnv(reservationTestDatabaseEnvKey)
+	if !ok || dbName == "" {
+		t.Skipf("set %s to a dedicated test schema to run this test", reservationTestDatabaseEnvKey)
+	}
+	t.Setenv("ISUCON13_MYSQL_DIALCONFIG_DATABASE", dbName)
+	db, err := connectDB(echo.New().Logger)
+	if err != nil {
+		t.Skipf("mysql is not available: %v", err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Skipf("mysql is not available: %v", err)
+	}
+
+	ctx := context.Background()
+	const (
+		width    = 3600
+		capacity = 5
+		numSlots = 4
+		workers  = 40
+	)
+	// 既存の予約枠と重ならないよう、ずっと先に作る
+	base := reservationConfig.SlotOrigin.AddDate(100, 0, 0).Unix() + int64(rand.Intn(1<<16))*width*numSlots
+	slotIDs := make([]int64, numSlots)
+	for i := range slotIDs {
+		rs, err := db.ExecContext(ctx, "INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (?, ?, ?)", capacity, base+int64(i)*width, base+int64(i+1)*width)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slotIDs[i], err = rs.LastInsertId(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, id := range slotIDs {
+			db.ExecContext(ctx, "DELETE FROM reservation_slots WHERE id = ?", id)
+		}
+	}()
+
+	checkSlots := func(expectedUsed []int64) {
+		t.Helper()
+		for i, id := range slotIDs {
+			var remaining int64
+			if err := db.GetContext(ctx, &remaining, "SELECT slot FROM reservation_slots WHERE id = ?", id); err != nil {
+				t.Fatal(err)
+			}
+			if remaining < 0 || remaining > capacity {
+				t.Errorf("slot %d: remaining %d is out of [0, %d]", i, remaining, capacity)
+			}
+			if remaining != capacity-expectedUsed[i] {
+				t.Errorf("slot %d: remaining %d, expected %d", i, remaining, capacity-expectedUsed[i])
+			}
+		}
+	}
+
+	type reservation struct{ from, to int }
+	var (
+		mu       sync.Mutex
+		used     = make([]int64, numSlots)
+		reserved []reservation
+	)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		from := rand.Intn(numSlots)
+		to := from + 1 + rand.Intn(numSlots-from)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx, err := db.BeginTxx(ctx, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer tx.Rollback()
+			if err := takeReservationSlots(ctx, tx, base+int64(from)*width, base+int64(to)*width); err != nil {
+				// 空きがない場合やデッドロックで失敗するのは構わない
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for i := from; i < to; i++ {
+				used[i]++
+			}
+			reserved = append(reserved, reservation{from, to})
+		}()
+	}
+	wg.Wait()
+
+	for i := range used {
+		if used[i] > capacity {
+			t.Errorf("slot %d: %d reservations exceed capacity %d", i, used[i], capacity)
+		}
+	}
+	checkSlots(used)
+
+	// 確保した分を並列に返却すると定員ちょうどに戻る
+	const releaseAttempts = 10
+	releaseErrs := make(chan error, len(reserved))
+	for _, r := range reserved {
+		r := r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// デッドロックで失敗したらやり直すが、失敗し続けるなら諦める
+			var err error
+			for attempt := 0; attempt < releaseAttempts; attempt++ {
+				var tx *sqlx.Tx
+				tx, err = db.BeginTxx(ctx, nil)
+				if err != nil {
+					continue
+				}
+				err = releaseReservationSlots(ctx, tx, base+int64(r.from)*width, base+int64(r.to)*width)
+				if err == nil {
+					err = tx.Commit()
+				}
+				tx.Rollback()
+				if err == nil {
+					return
+				}
+			}
+			releaseErrs <- err
+		}()
+	}
+	wg.Wait()
+	close(releaseErrs)
+	for err := range releaseErrs {
+		t.Fatalf("failed to release reservation slots after %d attempts: %v", releaseAttempts, err)
+	}
+	checkSlots(make([]int64, numSlots))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 重なる予約を拒否する
+	overlapPolicyReject = "reject"
+	// 予約は受け付けるが、重なる配信のIDをレスポンスのoverlapping_livestream_idsとヘッダで知らせる
+	overlapPolicyWarn = "warn"
+	// 重なりを調べない
+	overlapPolicyAllow = "allow"
+
+	reservationOverlapHeader = "X-Reservation-Overlap"
+)
+
+// userIDsの誰かが配信者またはコラボレーターとして参加する配信のうち、区間が重なるものを探す
+// キャンセルされた配信と、予定より早く終わったものも含めて終了済みの配信は数えない
+// NOTE: 同じユーザの並列な予約で重なりを見落とさないよう、ユーザの行をFOR UPDATEでロックする
+func findOverlappingLivestreamIDs(ctx context.Context, tx *sqlx.Tx, userIDs []int64, startAt, endAt int64, excludeLivestreamID int64) ([]int64, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In("SELECT id FROM users WHERE id IN (?) ORDER BY id FOR UPDATE", userIDs)
+	if err != nil {
+		return nil, err
+	}
+	var lockedIDs []int64
+	if err := tx.SelectContext(ctx, &lockedIDs, query, args...); err != nil {
+		return nil, err
+	}
+
+	query, args, err = sqlx.In(`
+		SELECT id FROM livestreams
+		WHERE (user_id IN (?) OR id IN (SELECT livestream_id FROM livestream_collaborators WHERE user_id IN (?) AND status = ?))
+		AND start_at < ? AND end_at > ? AND id != ? AND status NOT IN (?, ?)
+		ORDER BY start_at
+		`, userIDs, userIDs, collaboratorStatusAccepted, endAt, startAt, excludeLivestreamID, livestreamStatusCancelled, livestreamStatusEnded)
+	if err != nil {
+		return nil, err
+	}
+	var livestreamIDs []int64
+	if err := tx.SelectContext(ctx, &livestreamIDs, query, args...); err != nil {
+		return nil, err
+	}
+	return livestreamIDs, nil
+}
+
+// 設定された方針に従って配信の重なりを検査する
+// 警告する方針のときは、レスポンスに含められるよう重なる配信のIDを返す
+func checkReservationOverlap(c echo.Context, tx *sqlx.Tx, userIDs []int64, startAt, endAt int64, excludeLivestreamID int64) ([]int64, error) {
+	if reservationConfig.OverlapPolicy == overlapPolicyAllow {
+		return nil, nil
+	}
+
+	livestreamIDs, err := findOverlappingLivestreamIDs(c.Request().Context(), tx, userIDs, startAt, endAt, excludeLivestreamID)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get overlapping livestreams: "+err.Error())
+	}
+	if len(livestreamIDs) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, len(livestreamIDs))
+	for i, id := range livestreamIDs {
+		ids[i] = strconv.FormatInt(id, 10)
+	}
+	if reservationConfig.OverlapPolicy == overlapPolicyReject {
+		return nil, echo.NewHTTPError(http.StatusConflict, "overlaps with livestreams: "+strings.Join(ids, ","))
+	}
+	c.Response().Header().Add(reservationOverlapHeader, strings.Join(ids, ","))
+	return livestreamIDs, nil
+}
+
+// 配信者と、指定されたユーザ名のコラボレーターのユーザID一覧
+func getReservationParticipantIDs(ctx context.Context, tx *sqlx.Tx, ownerID int64, collaborators []string) ([]int64, error) {
+	userIDs := []int64{ownerID}
+	for _, username := range collaborators {
+		userModel, err := getUserByName(ctx, tx, username)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userModel.ID)
+	}
+	return userIDs, nil
+}
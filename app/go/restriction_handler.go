@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 相手からの操作を拒否し、相手のコメント・リアクションも表示しない
+	restrictionKindBlock = "block"
+	// 相手のコメント・リアクションを自分にだけ表示しない
+	restrictionKindMute = "mute"
+	// 配信者として、相手を自分の配信から締め出す
+	restrictionKindBan = "ban"
+)
+
+type UserRestrictionModel struct {
+	ID           int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	TargetUserID int64  `db:"target_user_id"`
+	Kind         string `db:"kind"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type userRestrictionKey struct {
+	UserID int64
+	Kind   string
+}
+
+var (
+	// userRestrictionKey -> map[int64]struct{}
+	userRestrictionCache = sync.Map{}
+)
+
+func getRestrictedUserIDs(ctx context.Context, tx *sqlx.Tx, userID int64, kind string) (map[int64]struct{}, error) {
+	key := userRestrictionKey{UserID: userID, Kind: kind}
+	if ids, ok := userRestrictionCache.Load(key); ok {
+		return ids.(map[int64]struct{}), nil
+	}
+
+	var targetIDs []int64
+	if err := tx.SelectContext(ctx, &targetIDs, "SELECT target_user_id FROM user_restrictions WHERE user_id = ? AND kind = ?", userID, kind); err != nil {
+		return nil, err
+	}
+	ids := make(map[int64]struct{}, len(targetIDs))
+	for _, id := range targetIDs {
+		ids[id] = struct{}{}
+	}
+	userRestrictionCache.Store(key, ids)
+
+	return ids, nil
+}
+
+// streamerの配信に対してuserIDが操作できないかどうか
+func isBannedByStreamer(ctx context.Context, tx *sqlx.Tx, streamerID int64, userID int64) (bool, error) {
+	for _, kind := range []string{restrictionKindBlock, restrictionKindBan} {
+		ids, err := getRestrictedUserIDs(ctx, tx, streamerID, kind)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := ids[userID]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// viewerに表示しないユーザのID一覧
+func getHiddenUserIDs(ctx context.Context, tx *sqlx.Tx, viewerID int64) ([]int64, error) {
+	var hidden []int64
+	for _, kind := range []string{restrictionKindBlock, restrictionKindMute} {
+		ids, err := getRestrictedUserIDs(ctx, tx, viewerID, kind)
+		if err != nil {
+			return nil, err
+		}
+		for id := range ids {
+			hidden = append(hidden, id)
+		}
+	}
+	return hidden, nil
+}
+
+// ブロックAPI
+// POST /api/user/:username/block
+func blockUserHandler(c echo.Context) error {
+	return postUserRestriction(c, restrictionKindBlock)
+}
+
+// ブロック解除API
+// DELETE /api/user/:username/block
+func unblockUserHandler(c echo.Context) error {
+	return deleteUserRestriction(c, restrictionKindBlock)
+}
+
+// ブロック一覧API
+// GET /api/user/me/blocks
+func getBlocksHandler(c echo.Context) error {
+	return listUserRestrictions(c, restrictionKindBlock)
+}
+
+// ミュートAPI
+// POST /api/user/:username/mute
+func muteUserHandler(c echo.Context) error {
+	return postUserRestriction(c, restrictionKindMute)
+}
+
+// ミュート解除API
+// DELETE /api/user/:username/mute
+func unmuteUserHandler(c echo.Context) error {
+	return deleteUserRestriction(c, restrictionKindMute)
+}
+
+// ミュート一覧API
+// GET /api/user/me/mutes
+func getMutesHandler(c echo.Context) error {
+	return listUserRestrictions(c, restrictionKindMute)
+}
+
+// (配信者向け)BAN API
+// POST /api/user/:username/ban
+func banUserHandler(c echo.Context) error {
+	return postUserRestriction(c, restrictionKindBan)
+}
+
+// (配信者向け)BAN解除API
+// DELETE /api/user/:username/ban
+func unbanUserHandler(c echo.Context) error {
+	return deleteUserRestriction(c, restrictionKindBan)
+}
+
+// (配信者向け)BAN一覧API
+// GET /api/user/me/bans
+func getBansHandler(c echo.Context) error {
+	return listUserRestrictions(c, restrictionKindBan)
+}
+
+func postUserRestriction(c echo.Context, kind string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	target, err := getUserByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+	if target.ID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't "+kind+" yourself")
+	}
+
+	if _, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO user_restrictions (user_id, target_user_id, kind, created_at) VALUES (:user_id, :target_user_id, :kind, :created_at)", &UserRestrictionModel{
+		UserID:       userID,
+		TargetUserID: target.ID,
+		Kind:         kind,
+		CreatedAt:    time.Now().Unix(),
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user restriction: "+err.Error())
+	}
+	// ブロックした相手とは、どちらの向きのフォローも解除する
+	if kind == restrictionKindBlock {
+		if err := deleteFollowsBetween(ctx, tx, userID, target.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follows: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	userRestrictionCache.Delete(userRestrictionKey{UserID: userID, Kind: kind})
+	if kind == restrictionKindBlock {
+		userFullCache.Delete(userID)
+		userFullCache.Delete(target.ID)
+	}
+
+	// フォロー数のキャッシュをコミット前の内容で埋めないよう、レスポンスはコミット後に作る
+	readTx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer readTx.Rollback()
+
+	user, err := fillUserResponse(ctx, readTx, target)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	if err := readTx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, user)
+}
+
+func deleteUserRestriction(c echo.Context, kind string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	target, err := getUserByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_restrictions WHERE user_id = ? AND kind = ? AND target_user_id = ?", userID, kind, target.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user restriction: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	userRestrictionCache.Delete(userRestrictionKey{UserID: userID, Kind: kind})
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func listUserRestrictions(c echo.Context, kind string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit, cursor, err := parseCursorPagination(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var userModels []relatedUserModel
+	if err := tx.SelectContext(ctx, &userModels, "SELECT u.*, r.id AS relation_id FROM users u INNER JOIN user_restrictions r ON r.target_user_id = u.id WHERE r.user_id = ? AND r.kind = ? AND (? = 0 OR r.id < ?) ORDER BY r.id DESC LIMIT ?", userID, kind, cursor.LastID, cursor.LastID, limit+1); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user restrictions: "+err.Error())
+	}
+	userModels, hasNext := trimPage(userModels, limit)
+	var nextCursor string
+	if hasNext {
+		nextCursor = encodePageCursor(pageCursor{LastID: userModels[len(userModels)-1].RelationID})
+	}
+
+	users := make([]User, len(userModels))
+	for i := range userModels {
+		user, err := fillUserResponse(ctx, tx, userModels[i].UserModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+		users[i] = user
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, Page[User]{Items: users, NextCursor: nextCursor})
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	seriesFrequencyDaily  = "daily"
+	seriesFrequencyWeekly = "weekly"
+
+	// 1回の繰り返し予約で作れる配信数の上限
+	maxSeriesOccurrences = 52
+)
+
+type LivestreamSeriesModel struct {
+	ID        int64  `db:"id"`
+	UserID    int64  `db:"user_id"`
+	Frequency string `db:"frequency"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type Recurrence struct {
+	// daily, weekly
+	Frequency string `json:"frequency"`
+	// 作成する回数。untilとどちらか一方を指定する
+	Count int `json:"count"`
+	// この時刻までに開始する回を作成する
+	Until int64 `json:"until"`
+}
+
+type ReserveRecurringLivestreamRequest struct {
+	ReserveLivestreamRequest
+	Recurrence Recurrence `json:"recurrence"`
+}
+
+type ReserveRecurringLivestreamResponse struct {
+	SeriesID    int64        `json:"series_id"`
+	Livestreams []Livestream `json:"livestreams"`
+}
+
+type ReservationConflict struct {
+	StartAt int64  `json:"start_at"`
+	EndAt   int64  `json:"end_at"`
+	Reason  string `json:"reason"`
+}
+
+type ReservationConflictResponse struct {
+	Error     string                `json:"error"`
+	Conflicts []ReservationConflict `json:"conflicts"`
+}
+
+type UpdateLivestreamSeriesRequest struct {
+	Title        *string `json:"title"`
+	Description  *string `json:"description"`
+	PlaylistUrl  *string `json:"playlist_url"`
+	ThumbnailUrl *string `json:"thumbnail_url"`
+}
+
+// 繰り返し予約の各回の区間を求める
+func expandRecurrence(startAt, endAt int64, recurrence Recurrence) ([]ReservationWindow, error) {
+	var interval int64
+	switch recurrence.Frequency {
+	case seriesFrequencyDaily:
+		interval = 24 * 60 * 60
+	case seriesFrequencyWeekly:
+		interval = 7 * 24 * 60 * 60
+	default:
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "recurrence.frequency must be daily or weekly")
+	}
+	if endAt-startAt > interval {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "each occurrence must not overlap the next one")
+	}
+	if (recurrence.Count > 0) == (recurrence.Until > 0) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "either recurrence.count or recurrence.until must be specified")
+	}
+
+	var occurrences []ReservationWindow
+	for i := int64(0); ; i++ {
+		occurrence := ReservationWindow{StartAt: startAt + i*interval, EndAt: endAt + i*interval}
+		if recurrence.Count > 0 && len(occurrences) >= recurrence.Count {
+			break
+		}
+		if recurrence.Until > 0 && occurrence.StartAt > recurrence.Until {
+			break
+		}
+		if len(occurrences) >= maxSeriesOccurrences {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "too many occurrences: up to "+strconv.Itoa(maxSeriesOccurrences))
+		}
+		occurrences = append(occurrences, occurrence)
+	}
+	if len(occurrences) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "recurrence has no occurrences")
+	}
+
+	return occurrences, nil
+}
+
+// 繰り返し配信予約API
+// POST /api/livestream/reservation/recurring
+func reserveRecurringLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *ReserveRecurringLivestreamRequest
+	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := validateMediaURLs(ctx, req.PlaylistUrl, req.ThumbnailUrl); err != nil {
+		return err
+	}
+
+	occurrences, err := expandRecurrence(req.StartAt, req.EndAt, req.Recurrence)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	participantIDs, err := getReservationParticipantIDs(ctx, tx, userID, req.Collaborators)
+	if err != nil {
+		return err
+	}
+
+	// 1回でも予約できなければ全体をロールバックするので、全回分の可否を調べてから返す
+	conflicts := []ReservationConflict{}
+	overlappingIDs := make([][]int64, len(occurrences))
+	for i, occurrence := range occurrences {
+		err := validateReservationTerm(occurrence.StartAt, occurrence.EndAt)
+		if err == nil {
+			overlappingIDs[i], err = checkReservationOverlap(c, tx, participantIDs, occurrence.StartAt, occurrence.EndAt, 0)
+		}
+		if err == nil {
+			err = takeReservationSlots(ctx, tx, occurrence.StartAt, occurrence.EndAt)
+		}
+		if err == nil {
+			continue
+		}
+
+		var he *echo.HTTPError
+		if !errors.As(err, &he) || (he.Code != http.StatusBadRequest && he.Code != http.StatusConflict) {
+			return err
+		}
+		conflicts = append(conflicts, ReservationConflict{
+			StartAt: occurrence.StartAt,
+			EndAt:   occurrence.EndAt,
+			Reason:  fmt.Sprint(he.Message),
+		})
+	}
+	if len(conflicts) > 0 {
+		return c.JSON(http.StatusConflict, ReservationConflictResponse{
+			Error:     "some occurrences can't be reserved",
+			Conflicts: conflicts,
+		})
+	}
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_series (user_id, frequency, created_at) VALUES (:user_id, :frequency, :created_at)", &LivestreamSeriesModel{
+		UserID:    userID,
+		Frequency: req.Recurrence.Frequency,
+		CreatedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream series: "+err.Error())
+	}
+	seriesID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream series id: "+err.Error())
+	}
+
+	livestreams := make([]Livestream, len(occurrences))
+	for i, occurrence := range occurrences {
+		livestreamModel := &LivestreamModel{
+			UserID:       userID,
+			Title:        req.Title,
+			Description:  req.Description,
+			PlaylistUrl:  req.PlaylistUrl,
+			ThumbnailUrl: req.ThumbnailUrl,
+			StartAt:      occurrence.StartAt,
+			EndAt:        occurrence.EndAt,
+			SeriesID:     &seriesID,
+		}
+		if err := insertLivestream(ctx, tx, livestreamModel, req.Tags); err != nil {
+			return err
+		}
+		if err := inviteCollaborators(ctx, tx, *livestreamModel, req.Collaborators); err != nil {
+			return err
+		}
+
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestream.OverlappingLivestreamIDs = overlappingIDs[i]
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, ReserveRecurringLivestreamResponse{
+		SeriesID:    seriesID,
+		Livestreams: livestreams,
+	})
+}
+
+// シリーズのうち、まだ開始していない回を排他ロックを取って取得する
+func getUpcomingSeriesLivestreamsForUpdate(ctx context.Context, tx *sqlx.Tx, seriesID int64, userID int64) ([]*LivestreamModel, error) {
+	series := LivestreamSeriesModel{}
+	if err := tx.GetContext(ctx, &series, "SELECT * FROM livestream_series WHERE id = ?", seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "not found livestream series that has the given id")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream series: "+err.Error())
+	}
+	if series.UserID != userID {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "can't modify other streamer's livestream series")
+	}
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE series_id = ? AND status = ? AND start_at > ? ORDER BY start_at FOR UPDATE", seriesID, livestreamStatusScheduled, time.Now().Unix()); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	return livestreamModels, nil
+}
+
+// 繰り返し予約の一括更新API
+// まだ開始していない回にだけ反映する
+// PATCH /api/livestream/series/:series_id
+func updateLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	seriesID, err := strconv.ParseInt(c.Param("series_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	var req *UpdateLivestreamSeriesRequest
+	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.PlaylistUrl != nil {
+		if err := validatePlaylistURL(ctx, *req.PlaylistUrl); err != nil {
+			return err
+		}
+	}
+	if req.ThumbnailUrl != nil {
+		if err := validateThumbnailURL(*req.ThumbnailUrl); err != nil {
+			return err
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModels, err := getUpcomingSeriesLivestreamsForUpdate(ctx, tx, seriesID, userID)
+	if err != nil {
+		return err
+	}
+
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		if req.Title != nil {
+			livestreamModel.Title = *req.Title
+		}
+		if req.Description != nil {
+			livestreamModel.Description = *req.Description
+		}
+		if req.PlaylistUrl != nil {
+			livestreamModel.PlaylistUrl = *req.PlaylistUrl
+		}
+		// アップロードされたサムネイルのパスなら、各配信のサムネイルはそのままにする
+		if req.ThumbnailUrl != nil && !isLivestreamThumbnailPath(*req.ThumbnailUrl) {
+			livestreamModel.ThumbnailUrl = *req.ThumbnailUrl
+			livestreamModel.ThumbnailHash = ""
+		}
+
+		if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, playlist_url = :playlist_url, thumbnail_url = :thumbnail_url, thumbnail_hash = :thumbnail_hash, sequence = sequence + 1 WHERE id = :id", livestreamModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+		}
+
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	for _, livestreamModel := range livestreamModels {
+		livestreamCache.Delete(int(livestreamModel.ID))
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+// 繰り返し予約の一括キャンセルAPI
+// まだ開始していない回をキャンセルする
+// DELETE /api/livestream/series/:series_id
+func cancelLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	seriesID, err := strconv.ParseInt(c.Param("series_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModels, err := getUpcomingSeriesLivestreamsForUpdate(ctx, tx, seriesID, userID)
+	if err != nil {
+		return err
+	}
+	for _, livestreamModel := range livestreamModels {
+		if err := cancelReservedLivestream(ctx, tx, *livestreamModel); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	for _, livestreamModel := range livestreamModels {
+		livestreamCache.Delete(int(livestreamModel.ID))
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
@@ -14,11 +15,16 @@ import (
 )
 
 type LivestreamStatistics struct {
-	Rank           int64 `json:"rank"`
-	ViewersCount   int64 `json:"viewers_count"`
-	TotalReactions int64 `json:"total_reactions"`
-	TotalReports   int64 `json:"total_reports"`
-	MaxTip         int64 `json:"max_tip"`
+	Rank int64 `json:"rank"`
+	// 現在の同時視聴者数
+	ViewersCount int64 `json:"viewers_count"`
+	// 最大同時視聴者数
+	PeakViewersCount int64 `json:"peak_viewers_count"`
+	// 一度でも入室したことのある視聴者数
+	UniqueViewersCount int64 `json:"unique_viewers_count"`
+	TotalReactions     int64 `json:"total_reactions"`
+	TotalReports       int64 `json:"total_reports"`
+	MaxTip             int64 `json:"max_tip"`
 }
 
 type LivestreamRankingEntry struct {
@@ -205,8 +211,9 @@ func getUserStatisticsHandler(c echo.Context) error {
 	}
 
 	// 合計視聴者数
+	// 退室しても視聴履歴は残るので、同じ配信への再入室は数えない
 	var viewersCount int64
-	if err := tx.GetContext(ctx, &viewersCount, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id IN (SELECT id FROM livestreams WHERE user_id = ?)", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := tx.GetContext(ctx, &viewersCount, "SELECT COUNT(DISTINCT livestream_id, user_id) FROM livestream_viewers_history WHERE livestream_id IN (SELECT id FROM livestreams WHERE user_id = ?)", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
 	}
 
@@ -336,11 +343,21 @@ GROUP BY l2.livestream_id
 		rank++
 	}
 
-	viewersCount, err := calcViewerCount(tx, ctx, livestreamID)
+	viewersCount, err := calcCurrentViewerCount(tx, ctx, livestreamID, time.Now())
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
 	}
 
+	peakViewersCount, err := calcPeakViewerCount(tx, ctx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get peak livestream viewers: "+err.Error())
+	}
+
+	uniqueViewersCount, err := calcUniqueViewerCount(tx, ctx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count unique livestream viewers: "+err.Error())
+	}
+
 	maxTip, err := calcMaxTip(tx, ctx, livestreamID)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find maximum tip livecomment: "+err.Error())
@@ -356,11 +373,13 @@ GROUP BY l2.livestream_id
 	}
 
 	return c.JSON(http.StatusOK, LivestreamStatistics{
-		Rank:           rank,
-		ViewersCount:   viewersCount,
-		MaxTip:         maxTip,
-		TotalReactions: totalReactions,
-		TotalReports:   totalReports,
+		Rank:               rank,
+		ViewersCount:       viewersCount,
+		PeakViewersCount:   peakViewersCount,
+		UniqueViewersCount: uniqueViewersCount,
+		MaxTip:             maxTip,
+		TotalReactions:     totalReactions,
+		TotalReports:       totalReports,
 	})
 }
 
@@ -381,12 +400,3 @@ func calcMaxTip(tx *sqlx.Tx, ctx context.Context, livestreamID int64) (int64, er
 	}
 	return maxTip, nil
 }
-
-// 視聴者数算出
-func calcViewerCount(tx *sqlx.Tx, ctx context.Context, livestreamID int64) (int64, error) {
-	var viewersCount int64
-	if err := tx.GetContext(ctx, &viewersCount, `SELECT COUNT(*) FROM livestream_viewers_history h WHERE h.livestream_id = ? GROUP BY h.livestream_id`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return 0, err
-	}
-	return viewersCount, nil
-}
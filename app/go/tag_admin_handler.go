@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-json-experiment/json"
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+)
+
+const maxTagNameLength = 255
+
+type TagRequest struct {
+	Name string `json:"name"`
+}
+
+type MergeTagRequest struct {
+	// マージ先のタグID
+	Into int64 `json:"into"`
+}
+
+func validateTagName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxTagNameLength {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "tag name must be 1 to "+strconv.Itoa(maxTagNameLength)+" bytes")
+	}
+	return name, nil
+}
+
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// タグの変更を全ノードのキャッシュに反映する
+func purgeTagCaches(c echo.Context) {
+	purgeCacheAfterCommit(c.Request().Context(), CachePurgeRequest{Tags: true, LivestreamTags: true})
+}
+
+// (管理者向け)タグ作成API
+// POST /api/admin/tag
+func postAdminTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req *TagRequest
+	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	name, err := validateTagName(req.Name)
+	if err != nil {
+		return err
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "INSERT INTO tags (name) VALUES (?)", name)
+	if err != nil {
+		if isDuplicateEntry(err) {
+			return echo.NewHTTPError(http.StatusConflict, "tag already exists")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag: "+err.Error())
+	}
+	tagID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted tag id: "+err.Error())
+	}
+
+	purgeTagCaches(c)
+
+	return c.JSON(http.StatusCreated, &Tag{ID: tagID, Name: name})
+}
+
+// (管理者向け)タグ名変更API
+// PUT /api/admin/tag/:tag_id
+func putAdminTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	var req *TagRequest
+	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	name, err := validateTagName(req.Name)
+	if err != nil {
+		return err
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "UPDATE tags SET name = ? WHERE id = ?", name, tagID)
+	if err != nil {
+		if isDuplicateEntry(err) {
+			return echo.NewHTTPError(http.StatusConflict, "tag already exists")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+	}
+	if n, err := rs.RowsAffected(); err == nil && n == 0 {
+		var exists bool
+		if err := dbConn.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM tags WHERE id = ?)", tagID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+		}
+		if !exists {
+			return echo.NewHTTPError(http.StatusNotFound, "not found tag that has the given id")
+		}
+	}
+
+	purgeTagCaches(c)
+
+	return c.JSON(http.StatusOK, &Tag{ID: tagID, Name: name})
+}
+
+// (管理者向け)タグ廃止API
+// 配信に付与されていたタグも外す
+// DELETE /api/admin/tag/:tag_id
+func deleteAdminTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", tagID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag: "+err.Error())
+	}
+	if n, err := rs.RowsAffected(); err == nil && n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "not found tag that has the given id")
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE tag_id = ?", tagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	purgeTagCaches(c)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// (管理者向け)タグのマージAPI
+// 配信に付与されたタグをマージ先に付け替えて、元のタグを消す
+// POST /api/admin/tag/:tag_id/merge
+func mergeAdminTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	var req *MergeTagRequest
+	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Into == tagID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't merge a tag into itself")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var tags []*Tag
+	if err := tx.SelectContext(ctx, &tags, "SELECT * FROM tags WHERE id IN (?, ?) FOR UPDATE", tagID, req.Into); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	if len(tags) != 2 {
+		return echo.NewHTTPError(http.StatusNotFound, "not found tag that has the given id")
+	}
+
+	// 既にマージ先のタグが付いている配信は、元のタグを外すだけにする
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE livestream_tags SET tag_id = ?
+		WHERE tag_id = ? AND livestream_id NOT IN (
+			SELECT livestream_id FROM (SELECT livestream_id FROM livestream_tags WHERE tag_id = ?) AS merged
+		)
+		`, req.Into, tagID, req.Into); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE tag_id = ?", tagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", tagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag: "+err.Error())
+	}
+
+	var into Tag
+	if err := tx.GetContext(ctx, &into, "SELECT * FROM tags WHERE id = ?", req.Into); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found tag that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	purgeTagCaches(c)
+
+	return c.JSON(http.StatusOK, &into)
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/google/uuid"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	takeoutStatusPending   = "pending"
+	takeoutStatusRunning   = "running"
+	takeoutStatusCompleted = "completed"
+	takeoutStatusFailed    = "failed"
+
+	// エクスポートしたZIPの保持期間
+	takeoutExpiration = 24 * time.Hour
+	// 期限切れのZIPを削除する間隔
+	takeoutCleanupInterval = 1 * time.Hour
+)
+
+var takeoutDir = filepath.Join(os.TempDir(), "isupipe-takeout")
+
+type TakeoutRelation struct {
+	Username  string `db:"name" json:"username"`
+	CreatedAt int64  `db:"created_at" json:"created_at"`
+}
+
+type TakeoutFollows struct {
+	Following []TakeoutRelation `json:"following"`
+	Followers []TakeoutRelation `json:"followers"`
+}
+
+type TakeoutRestriction struct {
+	// block, mute, ban
+	Kind      string `db:"kind" json:"kind"`
+	Username  string `db:"name" json:"username"`
+	CreatedAt int64  `db:"created_at" json:"created_at"`
+}
+
+type TakeoutCollaboration struct {
+	LivestreamID int64  `db:"livestream_id" json:"livestream_id"`
+	Status       string `db:"status" json:"status"`
+	CreatedAt    int64  `db:"created_at" json:"created_at"`
+}
+
+type TakeoutPresence struct {
+	LivestreamID int64 `db:"livestream_id" json:"livestream_id"`
+	LastSeenAt   int64 `db:"last_seen_at" json:"last_seen_at"`
+}
+
+type TakeoutJob struct {
+	ID          string `json:"id"`
+	UserID      int64  `json:"-"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	CreatedAt   int64  `json:"created_at"`
+	CompletedAt int64  `json:"completed_at,omitempty"`
+}
+
+var (
+	// job ID -> TakeoutJob
+	takeoutJobs = sync.Map{}
+	// user ID -> 実行中のjob ID
+	takeoutUserJobs = sync.Map{}
+	// takeoutUserJobsの確認と登録をまとめて行うためのロック
+	takeoutJobsLock sync.Mutex
+)
+
+func getTakeoutFilePath(jobID string) string {
+	return filepath.Join(takeoutDir, jobID+".zip")
+}
+
+// 個人データエクスポート開始API
+// POST /api/user/me/takeout
+func postTakeoutHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	job := TakeoutJob{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		Status:    takeoutStatusPending,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	// 同一ユーザのエクスポートが実行中であればそれを返す
+	takeoutJobsLock.Lock()
+	if runningID, ok := takeoutUserJobs.Load(userID); ok {
+		if running, ok := takeoutJobs.Load(runningID); ok {
+			takeoutJobsLock.Unlock()
+			return c.JSON(http.StatusAccepted, running.(TakeoutJob))
+		}
+	}
+	takeoutJobs.Store(job.ID, job)
+	takeoutUserJobs.Store(userID, job.ID)
+	takeoutJobsLock.Unlock()
+
+	go runTakeoutJob(job)
+
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// 個人データエクスポート状態取得API
+// GET /api/user/me/takeout/:takeout_id
+func getTakeoutHandler(c echo.Context) error {
+	job, err := getOwnTakeoutJob(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, job)
+}
+
+// 個人データエクスポートのダウンロードAPI
+// GET /api/user/me/takeout/:takeout_id/download
+func downloadTakeoutHandler(c echo.Context) error {
+	job, err := getOwnTakeoutJob(c)
+	if err != nil {
+		return err
+	}
+
+	if job.Status != takeoutStatusCompleted {
+		return echo.NewHTTPError(http.StatusConflict, "takeout is not completed yet")
+	}
+	if time.Since(time.Unix(job.CompletedAt, 0)) > takeoutExpiration {
+		takeoutJobs.Delete(job.ID)
+		os.Remove(getTakeoutFilePath(job.ID))
+		return echo.NewHTTPError(http.StatusGone, "takeout has expired")
+	}
+
+	return c.Attachment(getTakeoutFilePath(job.ID), fmt.Sprintf("isupipe-takeout-%s.zip", job.ID))
+}
+
+func getOwnTakeoutJob(c echo.Context) (TakeoutJob, error) {
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return TakeoutJob{}, err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	v, ok := takeoutJobs.Load(c.Param("takeout_id"))
+	if !ok {
+		return TakeoutJob{}, echo.NewHTTPError(http.StatusNotFound, "not found takeout that has the given id")
+	}
+	job := v.(TakeoutJob)
+	if job.UserID != userID {
+		return TakeoutJob{}, echo.NewHTTPError(http.StatusNotFound, "not found takeout that has the given id")
+	}
+
+	return job, nil
+}
+
+func runTakeoutJob(job TakeoutJob) {
+	defer func() {
+		takeoutJobsLock.Lock()
+		takeoutUserJobs.CompareAndDelete(job.UserID, job.ID)
+		takeoutJobsLock.Unlock()
+	}()
+
+	job.Status = takeoutStatusRunning
+	takeoutJobs.Store(job.ID, job)
+
+	size, err := writeTakeoutArchive(context.Background(), job)
+	if err != nil {
+		log.Printf("failed to write takeout archive (user_id=%d): %+v", job.UserID, err)
+		os.Remove(getTakeoutFilePath(job.ID))
+		job.Status = takeoutStatusFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = takeoutStatusCompleted
+		job.Size = size
+	}
+	job.CompletedAt = time.Now().Unix()
+	takeoutJobs.Store(job.ID, job)
+}
+
+func startTakeoutCleanup() {
+	ticker := time.NewTicker(takeoutCleanupInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if deleted, err := cleanupExpiredTakeouts(time.Now()); err != nil {
+			log.Printf("failed to clean up expired takeouts: %v", err)
+		} else if deleted > 0 {
+			log.Printf("takeout cleanup: deleted=%d", deleted)
+		}
+	}
+}
+
+// ダウンロードされないまま保持期間を過ぎたZIPを削除する
+// 再起動でジョブの情報が失われたファイルも、更新日時をみて削除する
+func cleanupExpiredTakeouts(now time.Time) (int, error) {
+	takeoutJobs.Range(func(key, value any) bool {
+		job := value.(TakeoutJob)
+		if job.CompletedAt != 0 && now.Sub(time.Unix(job.CompletedAt, 0)) > takeoutExpiration {
+			takeoutJobs.Delete(key)
+		}
+		return true
+	})
+
+	entries, err := os.ReadDir(takeoutDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		if !info.Mode().IsRegular() || now.Sub(info.ModTime()) <= takeoutExpiration {
+			continue
+		}
+		if err := os.Remove(filepath.Join(takeoutDir, entry.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func writeTakeoutArchive(ctx context.Context, job TakeoutJob) (int64, error) {
+	if err := os.MkdirAll(takeoutDir, 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.Create(getTakeoutFilePath(job.ID))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	tx, err := dbConn.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	userModel, err := getUser(ctx, tx, job.UserID)
+	if err != nil {
+		return 0, err
+	}
+	user, err := fillUserResponse(ctx, tx, userModel)
+	if err != nil {
+		return 0, err
+	}
+
+	zw := zip.NewWriter(f)
+
+	if err := writeTakeoutJSON(zw, "profile.json", user); err != nil {
+		return 0, err
+	}
+	if err := writeTakeoutIcon(ctx, zw, user.IconHash); err != nil {
+		return 0, err
+	}
+
+	// 存在しない配信はnilとして覚えておき、何度も問い合わせない
+	livestreams := map[int64]*Livestream{}
+	loadLivestream := func(livestreamID int64) (*Livestream, error) {
+		if livestream, ok := livestreams[livestreamID]; ok {
+			if livestream == nil {
+				return nil, sql.ErrNoRows
+			}
+			return livestream, nil
+		}
+		livestreamModel, err := getLivestream(ctx, tx, int(livestreamID))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				livestreams[livestreamID] = nil
+			}
+			return nil, err
+		}
+		livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+		if err != nil {
+			// 配信者のユーザが削除されている場合も、存在しない配信と同じく扱う
+			if errors.Is(err, sql.ErrNoRows) {
+				livestreams[livestreamID] = nil
+			}
+			return nil, err
+		}
+		livestreams[livestreamID] = &livestream
+		return &livestream, nil
+	}
+
+	// 自分の配信
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? ORDER BY id", job.UserID); err != nil {
+		return 0, err
+	}
+	ownLivestreams := make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+		if err != nil {
+			return 0, err
+		}
+		ownLivestreams[i] = livestream
+		livestreams[livestream.ID] = &ownLivestreams[i]
+	}
+	if err := writeTakeoutJSON(zw, "livestreams.json", ownLivestreams); err != nil {
+		return 0, err
+	}
+
+	// 投稿したライブコメント
+	var livecommentModels []LivecommentModel
+	if err := tx.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE user_id = ? ORDER BY created_at", job.UserID); err != nil {
+		return 0, err
+	}
+	livecomments := make([]Livecomment, 0, len(livecommentModels))
+	for i := range livecommentModels {
+		livestream, err := loadLivestream(livecommentModels[i].LivestreamID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// 配信が削除されていても、書き出し全体は失敗させずに読み飛ばす
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModels[i], livestream)
+		if err != nil {
+			return 0, err
+		}
+		livecomments = append(livecomments, livecomment)
+	}
+	if err := writeTakeoutJSON(zw, "livecomments.json", livecomments); err != nil {
+		return 0, err
+	}
+
+	// 送ったリアクション
+	var reactionModels []ReactionModel
+	if err := tx.SelectContext(ctx, &reactionModels, "SELECT * FROM reactions WHERE user_id = ? ORDER BY created_at", job.UserID); err != nil {
+		return 0, err
+	}
+	reactions := make([]Reaction, 0, len(reactionModels))
+	for i := range reactionModels {
+		livestream, err := loadLivestream(reactionModels[i].LivestreamID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// 配信が削除されていても、書き出し全体は失敗させずに読み飛ばす
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		reaction, err := fillReactionResponse(ctx, tx, reactionModels[i], livestream)
+		if err != nil {
+			return 0, err
+		}
+		reactions = append(reactions, reaction)
+	}
+	if err := writeTakeoutJSON(zw, "reactions.json", reactions); err != nil {
+		return 0, err
+	}
+
+	// スパム報告
+	var reportModels []LivecommentReportModel
+	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE user_id = ? ORDER BY created_at", job.UserID); err != nil {
+		return 0, err
+	}
+	reports := make([]LivecommentReport, 0, len(reportModels))
+	for i := range reportModels {
+		report, err := fillLivecommentReportResponse(ctx, tx, reportModels[i])
+		if errors.Is(err, sql.ErrNoRows) {
+			// NGワード登録で削除されたライブコメントへの報告
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		reports = append(reports, report)
+	}
+	if err := writeTakeoutJSON(zw, "livecomment_reports.json", reports); err != nil {
+		return 0, err
+	}
+
+	// 登録したNGワード
+	ngWords := []NGWord{}
+	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? ORDER BY created_at", job.UserID); err != nil {
+		return 0, err
+	}
+	if err := writeTakeoutJSON(zw, "ng_words.json", ngWords); err != nil {
+		return 0, err
+	}
+
+	// 視聴履歴
+	viewingHistory := []LivestreamViewerModel{}
+	if err := tx.SelectContext(ctx, &viewingHistory, "SELECT user_id, livestream_id, created_at FROM livestream_viewers_history WHERE user_id = ? ORDER BY created_at", job.UserID); err != nil {
+		return 0, err
+	}
+	if err := writeTakeoutJSON(zw, "viewing_history.json", viewingHistory); err != nil {
+		return 0, err
+	}
+
+	// 視聴中の配信
+	presences := []TakeoutPresence{}
+	if err := tx.SelectContext(ctx, &presences, "SELECT livestream_id, last_seen_at FROM livestream_presences WHERE user_id = ? ORDER BY last_seen_at", job.UserID); err != nil {
+		return 0, err
+	}
+	if err := writeTakeoutJSON(zw, "viewing_presences.json", presences); err != nil {
+		return 0, err
+	}
+
+	// フォロー・フォロワー
+	follows := TakeoutFollows{
+		Following: []TakeoutRelation{},
+		Followers: []TakeoutRelation{},
+	}
+	if err := tx.SelectContext(ctx, &follows.Following, "SELECT u.name, f.created_at FROM follows f INNER JOIN users u ON u.id = f.followee_id WHERE f.follower_id = ? ORDER BY f.created_at", job.UserID); err != nil {
+		return 0, err
+	}
+	if err := tx.SelectContext(ctx, &follows.Followers, "SELECT u.name, f.created_at FROM follows f INNER JOIN users u ON u.id = f.follower_id WHERE f.followee_id = ? ORDER BY f.created_at", job.UserID); err != nil {
+		return 0, err
+	}
+	if err := writeTakeoutJSON(zw, "follows.json", follows); err != nil {
+		return 0, err
+	}
+
+	// ブロック・ミュート・BANしたユーザ
+	restrictions := []TakeoutRestriction{}
+	if err := tx.SelectContext(ctx, &restrictions, "SELECT r.kind, u.name, r.created_at FROM user_restrictions r INNER JOIN users u ON u.id = r.target_user_id WHERE r.user_id = ? ORDER BY r.created_at", job.UserID); err != nil {
+		return 0, err
+	}
+	if err := writeTakeoutJSON(zw, "restrictions.json", restrictions); err != nil {
+		return 0, err
+	}
+
+	// コラボレーターとして招待された配信
+	collaborations := []TakeoutCollaboration{}
+	if err := tx.SelectContext(ctx, &collaborations, "SELECT livestream_id, status, created_at FROM livestream_collaborators WHERE user_id = ? ORDER BY created_at", job.UserID); err != nil {
+		return 0, err
+	}
+	if err := writeTakeoutJSON(zw, "collaborations.json", collaborations); err != nil {
+		return 0, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func writeTakeoutJSON(zw *zip.Writer, name string, v any) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	return json.MarshalWrite(w, v)
+}
+
+func writeTakeoutIcon(ctx context.Context, zw *zip.Writer, hash string) error {
+	var (
+		b   []byte
+		err error
+	)
+	switch {
+	case hash == fallbackImageHash:
+		b, err = os.ReadFile(fallbackImage)
+	case iconStore.Shared():
+		b, err = iconStore.Get(ctx, getUserIconObjectName(hash))
+	default:
+		// ローカルディスクの場合、アイコンは別インスタンスに保存されている
+		b, err = getFromIconNode(ctx, getUserIconObjectName(hash))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	w, err := zw.Create("icon.jpg")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
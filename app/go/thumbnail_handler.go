@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// サムネイルは16:9に切り抜く
+var thumbnailImageFormat = imageFormat{
+	label:             "thumbnail",
+	aspectWidth:       16,
+	aspectHeight:      9,
+	maxWidth:          1280,
+	variantWidths:     []int{320, 640},
+	objectName:        getThumbnailObjectName,
+	variantObjectName: getThumbnailVariantObjectName,
+}
+
+func getThumbnailObjectPrefix(hash string) string {
+	return "thumb_" + hash
+}
+
+func getThumbnailObjectName(hash string) string {
+	return getThumbnailObjectPrefix(hash) + ".jpg"
+}
+
+func getThumbnailVariantObjectName(hash string, width int) string {
+	return fmt.Sprintf("%s_%d.jpg", getThumbnailObjectPrefix(hash), width)
+}
+
+// アップロードされた画像があればこちらで配信しているURLを、なければ予約時に指定されたURLを返す
+func getLivestreamThumbnailURL(livestreamModel LivestreamModel) string {
+	if livestreamModel.ThumbnailHash == "" {
+		return livestreamModel.ThumbnailUrl
+	}
+	return fmt.Sprintf("/api/livestream/%d/thumbnail", livestreamModel.ID)
+}
+
+func parseThumbnailWidth(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	width, err := strconv.Atoi(v)
+	if err != nil || !slices.Contains(thumbnailImageFormat.variantWidths, width) {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("width query parameter must be one of %v", thumbnailImageFormat.variantWidths))
+	}
+	return width, nil
+}
+
+// 配信サムネイル取得API
+// GET /api/livestream/:livestream_id/thumbnail?width=
+func getLivestreamThumbnailHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	width, err := parseThumbnailWidth(c.QueryParam("width"))
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	hash := livestreamModel.ThumbnailHash
+	if hash == "" {
+		if livestreamModel.ThumbnailUrl == "" {
+			return echo.NewHTTPError(http.StatusNotFound, "the livestream has no thumbnail")
+		}
+		// アップロードされていなければ予約時に指定された画像へ
+		return c.Redirect(http.StatusFound, livestreamModel.ThumbnailUrl)
+	}
+
+	etag := "\"" + hash + "\""
+	name := getThumbnailObjectName(hash)
+	if width > 0 && !iconStore.Shared() {
+		// ローカルディスクの場合、画像は別インスタンスに保存されていてここからは見えない
+		// 縮小版はアップロード時に作っているので、存在を確かめずにnginxに任せる
+		etag = fmt.Sprintf("\"%s_%d\"", hash, width)
+		name = getThumbnailVariantObjectName(hash, width)
+	} else if width > 0 {
+		err := thumbnailImageFormat.ensureVariant(ctx, hash, width)
+		if err == nil {
+			// 縮小版は元画像から一意に決まるので、幅込みでETagとする
+			etag = fmt.Sprintf("\"%s_%d\"", hash, width)
+			name = getThumbnailVariantObjectName(hash, width)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to resize thumbnail: "+err.Error())
+		}
+	}
+
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "image/jpeg")
+	header.Set("ETag", etag)
+	return iconStore.Serve(c, name)
+}
+
+func verifyThumbnailUpdatable(livestreamModel LivestreamModel, userID int64) error {
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't modify other streamer's livestream")
+	}
+	switch livestreamModel.EffectiveStatus(time.Now().Unix()) {
+	case livestreamStatusEnded, livestreamStatusCancelled:
+		return echo.NewHTTPError(http.StatusBadRequest, "can't update a livestream that has ended or been cancelled")
+	}
+	return nil
+}
+
+// 配信サムネイルのアップロードAPI
+// POST /api/livestream/:livestream_id/thumbnail
+func postLivestreamThumbnailHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// 画像の変換や別インスタンスへの保存の間は行をロックしないよう、先にロックせず確認しておく
+	livestreamModel := LivestreamModel{}
+	if err := dbConn.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if err := verifyThumbnailUpdatable(livestreamModel, userID); err != nil {
+		return err
+	}
+
+	var hexHash string
+	if iconStore.Shared() {
+		req, err := decodePostIconRequest(c)
+		if err != nil {
+			return err
+		}
+		if hexHash, err = thumbnailImageFormat.save(ctx, req.Image); err != nil {
+			return err
+		}
+	} else {
+		// 別のインスタンスにリクエスト
+		if hexHash, err = postToIconNode("/api/internal/thumbnail", c.Request().Body); err != nil {
+			return err
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 保存している間に状態が変わっているかもしれないので、ロックして確認し直す
+	livestreamModel, err = getOwnedLivestreamForUpdate(ctx, tx, livestreamID, userID)
+	if err != nil {
+		return err
+	}
+	if err := verifyThumbnailUpdatable(livestreamModel, userID); err != nil {
+		return err
+	}
+
+	livestreamModel.ThumbnailHash = hexHash
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET thumbnail_hash = ?, sequence = sequence + 1 WHERE id = ?", hexHash, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	livestreamCache.Delete(livestreamID)
+
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+func postInternalThumbnailHandler(c echo.Context) error {
+	if err := verifyInternalRequest(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	req, err := decodePostIconRequest(c)
+	if err != nil {
+		return err
+	}
+
+	hexHash, err := thumbnailImageFormat.save(c.Request().Context(), req.Image)
+	if err != nil {
+		return err
+	}
+
+	return c.String(http.StatusOK, hexHash)
+}
@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
@@ -48,6 +50,9 @@ type User struct {
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// フォロワー数、フォロー数
+	FollowerCount  int64 `json:"follower_count"`
+	FollowingCount int64 `json:"following_count"`
 }
 
 type Theme struct {
@@ -92,11 +97,20 @@ func getIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	username := c.Param("username")
 
+	size, err := parseIconSize(c.QueryParam("size"))
+	if err != nil {
+		return err
+	}
+
 	hash, err := getUserIconHash(ctx, username)
 	if err != nil {
 		return err
 	}
 	etag := "\"" + hash + "\""
+	if size > 0 {
+		// 縮小版は元画像から一意に決まるので、サイズ込みでETagとする
+		etag = fmt.Sprintf("\"%s_%d\"", hash, size)
+	}
 
 	extectedEtag := c.Request().Header.Get("If-None-Match")
 	if etag == extectedEtag {
@@ -110,18 +124,115 @@ func getIconHandler(c echo.Context) error {
 		//c.Response().Header().Set(echo.HeaderContentType, "image/jpeg")
 		//c.Response().Header().Set("X-Accel-Redirect", "/home/isucon/webapp/img/NoImage.jpg")
 		//return c.NoContent(http.StatusOK)
+		if size > 0 {
+			b, err := getFallbackIconVariant(size)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to resize fallback icon: "+err.Error())
+			}
+			return c.Blob(http.StatusOK, "image/jpeg", b)
+		}
 		return c.File(fallbackImage)
 	}
 
+	name := getUserIconObjectName(hash)
+	if size > 0 && !iconStore.Shared() {
+		// ローカルディスクの場合、画像は別インスタンスに保存されていてここからは見えない
+		// 縮小版はアップロード時に作っているので、存在を確かめずにnginxに任せる
+		name = getUserIconVariantObjectName(hash, size)
+	} else if size > 0 {
+		err := iconImageFormat.ensureVariant(ctx, hash, size)
+		if err == nil {
+			name = getUserIconVariantObjectName(hash, size)
+		} else if errors.Is(err, fs.ErrNotExist) {
+			// 元画像が見つからなければ原寸で返す
+			etag = "\"" + hash + "\""
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to resize icon: "+err.Error())
+		}
+	}
+
 	header.Set("ETag", etag)
-	header.Set("X-Accel-Redirect", fmt.Sprintf("/home/isucon/webapp/img/%s.jpg", hash))
-	return c.NoContent(http.StatusOK)
+	return iconStore.Serve(c, name)
 }
 
 const UserIconImageDir = "/home/isucon/webapp/img"
 
-func getUserIconFilePath(hash string) string {
-	return fmt.Sprintf("%s/%s.jpg", UserIconImageDir, hash)
+func getUserIconObjectName(hash string) string {
+	return hash + ".jpg"
+}
+
+func getUserIconVariantObjectName(hash string, size int) string {
+	return fmt.Sprintf("%s_%d.jpg", hash, size)
+}
+
+// sizeクエリを検証する。指定がなければ0(原寸)を返す
+func parseIconSize(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || !slices.Contains(iconImageFormat.variantWidths, size) {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("size query parameter must be one of %v", iconImageFormat.variantWidths))
+	}
+	return size, nil
+}
+
+var fallbackIconVariantCache = sync.Map{}
+
+func getFallbackIconVariant(size int) ([]byte, error) {
+	if b, ok := fallbackIconVariantCache.Load(size); ok {
+		return b.([]byte), nil
+	}
+
+	original, err := os.ReadFile(fallbackImage)
+	if err != nil {
+		return nil, err
+	}
+	b, err := iconImageFormat.resize(original, size)
+	if err != nil {
+		return nil, err
+	}
+	fallbackIconVariantCache.Store(size, b)
+	return b, nil
+}
+
+func decodePostIconRequest(c echo.Context) (*PostIconRequest, error) {
+	// base64エンコードされる分を見込んで上限をかける
+	body := http.MaxBytesReader(c.Response(), c.Request().Body, maxIconUploadSize/3*4+1024)
+	var req *PostIconRequest
+	if err := json.UnmarshalRead(body, &req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, "image is too large")
+		}
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	return req, nil
+}
+
+// 画像を保存するインスタンス
+const iconNodeURL = "http://192.168.0.11:8080"
+
+// 画像を保存するインスタンスにリクエストを転送し、レスポンスボディを返す
+func postToIconNode(path string, body io.Reader) (string, error) {
+	resp, err := http.Post(iconNodeURL+path, "application/json; charset=UTF-8", body)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError, "failed to post internal icon: "+err.Error())
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError, "failed to post internal icon: "+err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		// 画像の検証エラーなどはそのままクライアントに返す
+		var errResp ErrorResponse
+		if err := json.Unmarshal(b, &errResp); err != nil {
+			return "", echo.NewHTTPError(http.StatusInternalServerError, "failed to post internal icon: "+resp.Status)
+		}
+		return "", echo.NewHTTPError(resp.StatusCode, errResp.Error)
+	}
+	return string(b), nil
 }
 
 func postIconHandler(c echo.Context) error {
@@ -138,17 +249,21 @@ func postIconHandler(c echo.Context) error {
 	userID := sess.Values[defaultUserIDKey].(int64)
 	userName := sess.Values[defaultUsernameKey].(string)
 
-	// 別のインスタンスにリクエスト
-	hexHash := ""
-	if resp, err := http.Post("http://192.168.0.11:8080/api/internal/icon", "application/json; charset=UTF-8", c.Request().Body); err != nil || resp.StatusCode != http.StatusOK {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to post internal icon: "+err.Error())
-	} else {
-		defer resp.Body.Close()
-		b, err := io.ReadAll(resp.Body)
+	var hexHash string
+	if iconStore.Shared() {
+		req, err := decodePostIconRequest(c)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to post internal icon: "+err.Error())
+			return err
+		}
+		if hexHash, err = iconImageFormat.save(ctx, req.Image); err != nil {
+			return err
+		}
+	} else {
+		// 別のインスタンスにリクエスト
+		var err error
+		if hexHash, err = postToIconNode("/api/internal/icon", c.Request().Body); err != nil {
+			return err
 		}
-		hexHash = string(b)
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -184,24 +299,70 @@ func postIconHandler(c echo.Context) error {
 }
 
 func postInternalIconHandler(c echo.Context) error {
-	var req *PostIconRequest
-	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read request body: "+err.Error())
+	if err := verifyInternalRequest(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
-	iconHash := sha256.Sum256(req.Image)
-	hexHash := hex.EncodeToString(iconHash[:])
-	f, err := os.OpenFile(getUserIconFilePath(hexHash), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0777)
+
+	req, err := decodePostIconRequest(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return err
 	}
-	defer f.Close()
-	if _, err := f.Write(req.Image); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+
+	hexHash, err := iconImageFormat.save(c.Request().Context(), req.Image)
+	if err != nil {
+		return err
 	}
 
 	return c.String(http.StatusOK, hexHash)
 }
 
+// 画像を保存するインスタンスからアイコン画像を取得する
+// 見つからなければfs.ErrNotExistをラップしたエラーを返す
+func getFromIconNode(ctx context.Context, name string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, iconNodeURL+"/api/internal/icon/"+url.PathEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("icon %s: %w", name, fs.ErrNotExist)
+	default:
+		return nil, fmt.Errorf("failed to get internal icon: %s", resp.Status)
+	}
+}
+
+// 保存しているアイコン画像をそのまま返す
+// GET /api/internal/icon/:name
+func getInternalIconHandler(c echo.Context) error {
+	if err := verifyInternalRequest(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	name := c.Param("name")
+	if !iconObjectNamePattern.MatchString(name) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found icon")
+	}
+
+	b, err := iconStore.Get(c.Request().Context(), name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found icon")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon: "+err.Error())
+	}
+
+	return c.Blob(http.StatusOK, "image/jpeg", b)
+}
+
 func getMeHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -475,6 +636,14 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 		hash = fallbackImageHash
 	}
 
+	var follows struct {
+		Followers int64 `db:"followers"`
+		Following int64 `db:"following"`
+	}
+	if err := tx.GetContext(ctx, &follows, "SELECT (SELECT COUNT(*) FROM follows WHERE followee_id = ?) AS followers, (SELECT COUNT(*) FROM follows WHERE follower_id = ?) AS following", userModel.ID, userModel.ID); err != nil {
+		return User{}, err
+	}
+
 	user := User{
 		ID:          userModel.ID,
 		Name:        userModel.Name,
@@ -484,7 +653,9 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 			ID:       themeModel.ID,
 			DarkMode: themeModel.DarkMode,
 		},
-		IconHash: hash,
+		IconHash:       hash,
+		FollowerCount:  follows.Followers,
+		FollowingCount: follows.Following,
 	}
 	userFullCache.Store(userModel.ID, user)
 
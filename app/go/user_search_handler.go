@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	userSearchSortFollowers = "followers"
+	userSearchSortScore     = "score"
+)
+
+// 一致の度合い。小さいほど上位
+const (
+	userMatchExact = iota
+	userMatchNamePrefix
+	userMatchDisplayNamePrefix
+	userMatchPartial
+)
+
+type userSearchCandidate struct {
+	UserModel
+	Match     int   `db:"match_rank"`
+	Followers int64 `db:"followers"`
+	score     int64
+}
+
+// ユーザ検索API
+// GET /api/user/search?q=&sort=&limit=&cursor=
+// nameかdisplay_nameにqを含むユーザを、一致の度合いが高い順に返す
+// 部分一致はLIKEで探すため、インデックスは効かずusersを毎回走査する
+func searchUsersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	q := strings.TrimSpace(c.QueryParam("q"))
+	if q == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "q query parameter is required")
+	}
+
+	sortBy := c.QueryParam("sort")
+	switch sortBy {
+	case "":
+		sortBy = userSearchSortFollowers
+	case userSearchSortFollowers, userSearchSortScore:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "sort query parameter must be followers or score")
+	}
+
+	limit, cursor, err := parseCursorPagination(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	pattern := "%" + escapeLike(q) + "%"
+	prefixPattern := escapeLike(q) + "%"
+	query := `
+		SELECT u.*, IFNULL(fc.followers, 0) AS followers,
+			CASE
+				WHEN u.name = ? COLLATE utf8mb4_unicode_ci THEN ?
+				WHEN u.name LIKE ? COLLATE utf8mb4_unicode_ci THEN ?
+				WHEN u.display_name LIKE ? COLLATE utf8mb4_unicode_ci THEN ?
+				ELSE ?
+			END AS match_rank
+		FROM users u
+		LEFT JOIN user_follower_counts fc ON fc.user_id = u.id
+		WHERE u.name LIKE ? COLLATE utf8mb4_unicode_ci OR u.display_name LIKE ? COLLATE utf8mb4_unicode_ci
+		`
+	args := []any{
+		q, userMatchExact,
+		prefixPattern, userMatchNamePrefix,
+		prefixPattern, userMatchDisplayNamePrefix,
+		userMatchPartial,
+		pattern, pattern,
+	}
+	// フォロワー数順はSQLで並べ替えてlimit件だけ取得する
+	// スコア順はランキングがメモリ上にしかないので、一致したユーザ全員を取得してから並べ替える
+	if sortBy == userSearchSortFollowers {
+		query += `
+		HAVING ? = 0 OR match_rank > ? OR (match_rank = ? AND (followers < ? OR (followers = ? AND u.id > ?)))
+		ORDER BY match_rank, followers DESC, u.id
+		LIMIT ?
+		`
+		followers := int64(cursor.Score)
+		args = append(args, cursor.LastID, cursor.Match, cursor.Match, followers, followers, cursor.LastID, limit+1)
+	}
+	var candidates []*userSearchCandidate
+	if err := tx.SelectContext(ctx, &candidates, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to search users: "+err.Error())
+	}
+
+	if sortBy == userSearchSortScore {
+		ranking, err := getUserRanking()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get ranking: "+err.Error())
+		}
+		scores := make(map[string]int64, len(ranking))
+		for _, entry := range ranking {
+			scores[entry.Username] = entry.Score
+		}
+		for _, candidate := range candidates {
+			candidate.score = scores[candidate.Name]
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].Match != candidates[j].Match {
+				return candidates[i].Match < candidates[j].Match
+			}
+			if candidates[i].score != candidates[j].score {
+				return candidates[i].score > candidates[j].score
+			}
+			return candidates[i].ID < candidates[j].ID
+		})
+		// 直前のページ末尾の(一致の度合い, スコア, ID)より後ろから返す
+		if cursor.LastID > 0 {
+			candidates = candidates[sort.Search(len(candidates), func(i int) bool {
+				return candidates[i].after(cursor)
+			}):]
+		}
+	} else {
+		for _, candidate := range candidates {
+			candidate.score = candidate.Followers
+		}
+	}
+
+	candidates, hasNext := trimPage(candidates, limit)
+	var nextCursor string
+	if hasNext {
+		last := candidates[len(candidates)-1]
+		nextCursor = encodePageCursor(pageCursor{LastID: last.ID, Match: last.Match, Score: float64(last.score)})
+	}
+
+	users := make([]User, len(candidates))
+	for i := range candidates {
+		user, err := fillUserResponse(ctx, tx, candidates[i].UserModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+		users[i] = user
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, Page[User]{Items: users, NextCursor: nextCursor})
+}
+
+// 検索結果の並び順でcursorより後ろにあるか
+func (candidate *userSearchCandidate) after(cursor pageCursor) bool {
+	if candidate.Match != cursor.Match {
+		return candidate.Match > cursor.Match
+	}
+	if score := float64(candidate.score); score != cursor.Score {
+		return score < cursor.Score
+	}
+	return candidate.ID > cursor.LastID
+}
+
+// LIKEのワイルドカードをエスケープする
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
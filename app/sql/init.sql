@@ -10,6 +10,14 @@ TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
 TRUNCATE TABLE users;
+TRUNCATE TABLE follows;
+TRUNCATE TABLE user_follower_counts;
+TRUNCATE TABLE user_restrictions;
+TRUNCATE TABLE livestream_series;
+TRUNCATE TABLE livestream_collaborators;
+TRUNCATE TABLE livestream_presences;
+TRUNCATE TABLE livestream_viewer_peaks;
+TRUNCATE TABLE ical_tokens;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
@@ -22,4 +30,9 @@ ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
-ALTER TABLE `users` auto_increment = 1;
\ No newline at end of file
+ALTER TABLE `users` auto_increment = 1;
+ALTER TABLE `follows` auto_increment = 1;
+ALTER TABLE `user_restrictions` auto_increment = 1;
+ALTER TABLE `livestream_series` auto_increment = 1;
+ALTER TABLE `livestream_collaborators` auto_increment = 1;
+ALTER TABLE `livestream_presences` auto_increment = 1;
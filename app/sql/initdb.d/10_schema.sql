@@ -41,6 +41,28 @@ CREATE TABLE `livestreams` (
   `thumbnail_url` VARCHAR(255) NOT NULL,
   `start_at` BIGINT NOT NULL,
   `end_at` BIGINT NOT NULL,
+  -- 繰り返し予約で作られた配信の場合のみ設定される
+  `series_id` BIGINT NULL,
+  -- scheduled, live, ended, cancelled
+  -- 配信者が操作しない限りscheduledのままで、実際の状態は時刻から求める
+  `status` VARCHAR(16) NOT NULL DEFAULT 'scheduled',
+  -- 予約内容が変更されるたびに増やす
+  `sequence` BIGINT NOT NULL DEFAULT 0,
+  -- アップロードされたサムネイル画像のハッシュ。空ならthumbnail_urlを使う
+  `thumbnail_hash` VARCHAR(64) NOT NULL DEFAULT '',
+  INDEX `idx_user_id` (`user_id`),
+  INDEX `idx_series_id` (`series_id`),
+  FULLTEXT INDEX `ft_title_description` (`title`, `description`) WITH PARSER ngram
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 繰り返し予約
+DROP TABLE IF EXISTS `livestream_series`;
+CREATE TABLE `livestream_series` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  -- daily, weekly
+  `frequency` VARCHAR(16) NOT NULL,
+  `created_at` BIGINT NOT NULL,
   INDEX `idx_user_id` (`user_id`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
@@ -78,7 +100,30 @@ CREATE TABLE `livestream_viewers_history` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
-  `created_at` BIGINT NOT NULL
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_livestream_id_user_id` (`livestream_id`, `user_id`),
+  INDEX `idx_user_id_livestream_id` (`user_id`, `livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信の現在の視聴者
+-- ハートビートが途絶えてlast_seen_atが古くなった行は視聴者として数えず、しばらくしたら削除する
+DROP TABLE IF EXISTS `livestream_presences`;
+CREATE TABLE `livestream_presences` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `last_seen_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_id_user_id` (`livestream_id`, `user_id`),
+  INDEX `idx_livestream_id_last_seen_at` (`livestream_id`, `last_seen_at`),
+  INDEX `idx_last_seen_at` (`last_seen_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信の最大同時視聴者数
+DROP TABLE IF EXISTS `livestream_viewer_peaks`;
+CREATE TABLE `livestream_viewer_peaks` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `peak_viewers` BIGINT NOT NULL,
+  `peaked_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信に対するライブコメント
@@ -127,3 +172,55 @@ CREATE TABLE `reactions` (
   `created_at` BIGINT NOT NULL,
   INDEX `idx_livesream_id` (`livestream_id`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザのフォロー関係
+DROP TABLE IF EXISTS `follows`;
+CREATE TABLE `follows` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `follower_id` BIGINT NOT NULL,
+  `followee_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_follower_id_followee_id` (`follower_id`, `followee_id`),
+  INDEX `idx_followee_id` (`followee_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザごとのフォロワー数。フォローの増減と同じトランザクションで更新する
+DROP TABLE IF EXISTS `user_follower_counts`;
+CREATE TABLE `user_follower_counts` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `followers` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザによるブロック・ミュート、配信者によるBAN
+DROP TABLE IF EXISTS `user_restrictions`;
+CREATE TABLE `user_restrictions` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `target_user_id` BIGINT NOT NULL,
+  -- block, mute, ban
+  `kind` VARCHAR(16) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_user_id_kind_target_user_id` (`user_id`, `kind`, `target_user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信のコラボレーター
+DROP TABLE IF EXISTS `livestream_collaborators`;
+CREATE TABLE `livestream_collaborators` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  -- invited, accepted
+  `status` VARCHAR(16) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_id_user_id` (`livestream_id`, `user_id`),
+  INDEX `idx_user_id_status` (`user_id`, `status`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- フォロー中の配信者のスケジュールをカレンダーアプリから購読するためのトークン
+DROP TABLE IF EXISTS `ical_tokens`;
+CREATE TABLE `ical_tokens` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `token` VARCHAR(64) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_token` (`token`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;